@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var buildForce bool
+
+var buildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "Start a build when there is a new release, exactly like the scheduled checks of the stack",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSBuild(stack.StackConfig{
+			Name:   name,
+			Region: region,
+		}, buildForce)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	addStackFlags(buildCmd)
+	buildCmd.Flags().BoolVar(&buildForce, "force", false, "start a build even when the latest release has been built already or the build window is closed.")
+	RootCmd.AddCommand(buildCmd)
+}
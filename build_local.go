@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var localDir string
+var renderOnly bool
+
+var buildLocalCmd = &cobra.Command{
+	Use:   "build-local",
+	Short: "Build a signed release on this machine without AWS",
+	Long: `Build a signed release on this (Ubuntu) machine with the same build script used on AWS. Keys, releases and logs are
+kept in the keys, release and logs directories of --dir and notifications are printed to stdout. The OTA update URL is
+derived from --name, --ota-domain and --s3-endpoint like it is for a stack, so the release can be published to it with the publish command.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		return validateDevice()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.LocalBuild(stack.StackConfig{
+			Name:       name,
+			Device:     device,
+			OTADomain:  otaDomain,
+			S3Endpoint: s3Endpoint,
+			Version:    stackVersion(),
+		}, localDir, renderOnly)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	buildLocalCmd.Flags().StringVarP(&name, "name", "n", "", "name of the stack the release will be published to.")
+	buildLocalCmd.MarkFlagRequired("name")
+	buildLocalCmd.Flags().StringVarP(&device, "device", "d", "", "device you want to build for: 'marlin' (Pixel XL) or 'sailfish' (Pixel)")
+	buildLocalCmd.MarkFlagRequired("device")
+	buildLocalCmd.Flags().StringVar(&otaDomain, "ota-domain", "", "custom domain the stack serves OTA updates from, if any.")
+	buildLocalCmd.Flags().StringVar(&localDir, "dir", "copperheados-build", "directory to build in and keep keys, releases and logs in.")
+	buildLocalCmd.Flags().BoolVar(&renderOnly, "render-only", false, "only write the build script to --dir without running it.")
+	addS3EndpointFlag(buildLocalCmd)
+	RootCmd.AddCommand(buildLocalCmd)
+}
@@ -0,0 +1,613 @@
+package checker
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/sirupsen/logrus"
+)
+
+// Actions the checker is invoked with by the schedules of a stack
+const (
+	ActionCheck    = ""
+	ActionFallback = "fallback"
+	ActionDeferred = "deferred"
+)
+
+// Fallback policies for spot fleets that aren't fulfilled in time
+const (
+	FallbackNone       = "none"
+	FallbackOnDemand   = "on-demand"
+	FallbackRaisePrice = "raise-price"
+)
+
+// deferredBuildKey marks a release found outside of the build window in the
+// stack bucket, it is built once the window opens
+const deferredBuildKey = "deferred-build"
+
+// fallbackCheckInterval is how often the fallback schedule invokes the checker
+const fallbackCheckInterval = 15 * time.Minute
+
+// Checker starts the builds of a stack.
+type Checker struct {
+	config       *Config
+	accountID    string
+	ec2Client    *ec2.EC2
+	s3Client     *s3.S3
+	snsClient    *sns.SNS
+	dynamoClient *dynamodb.DynamoDB
+}
+
+// New creates a checker for the stack described by config.
+func New(config *Config) (*Checker, error) {
+	sess, err := session.NewSession(aws.NewConfig().WithRegion(config.Region).WithCredentialsChainVerboseErrors(true))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create new AWS session: %v", err)
+	}
+	// the account fills in the fleet role and instance profile
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get AWS account: %v", err)
+	}
+
+	s3Config := &aws.Config{}
+	if config.S3Endpoint != "" {
+		s3Config.Endpoint = aws.String(config.S3Endpoint)
+		s3Config.S3ForcePathStyle = aws.Bool(true)
+		s3Config.Credentials, err = s3EndpointCredentials(ssm.New(sess), config.Name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Checker{
+		config:       config,
+		accountID:    aws.StringValue(identity.Account),
+		ec2Client:    ec2.New(sess),
+		s3Client:     s3.New(sess, s3Config),
+		snsClient:    sns.New(sess),
+		dynamoClient: dynamodb.New(sess),
+	}, nil
+}
+
+// s3EndpointCredentials reads the credentials of the S3 compatible service of
+// a stack from SSM.
+func s3EndpointCredentials(ssmClient *ssm.SSM, name string) (*credentials.Credentials, error) {
+	output, err := ssmClient.GetParameters(&ssm.GetParametersInput{
+		Names:          aws.StringSlice([]string{S3EndpointKeyIDParameter(name), S3EndpointSecretParameter(name)}),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get S3 endpoint credentials: %v", err)
+	}
+	values := map[string]string{}
+	for _, parameter := range output.Parameters {
+		values[aws.StringValue(parameter.Name)] = aws.StringValue(parameter.Value)
+	}
+	keyID, secret := values[S3EndpointKeyIDParameter(name)], values[S3EndpointSecretParameter(name)]
+	if keyID == "" || secret == "" {
+		return nil, fmt.Errorf("Missing S3 endpoint credentials %s and %s, deploy the stack again", S3EndpointKeyIDParameter(name), S3EndpointSecretParameter(name))
+	}
+	return credentials.NewStaticCredentials(keyID, secret, ""), nil
+}
+
+// Run handles an invocation of the checker. Unless force is set, a build is
+// only started when there is a new official release, and only inside of the
+// build window. A build is never started while another one is running. A
+// deferred build stays pending until its build has been requested.
+func (checker *Checker) Run(action string, force bool) error {
+	deferred := false
+	switch action {
+	case ActionFallback:
+		return checker.checkFallback()
+	case ActionDeferred:
+		if !checker.config.BuildWindow.InWindow(time.Now()) {
+			return nil
+		}
+		pending, err := checker.deferredBuildPending()
+		if err != nil || !pending {
+			return err
+		}
+		log.Info("Starting deferred build")
+		deferred = true
+	case ActionCheck:
+	default:
+		return fmt.Errorf("Unknown action %s", action)
+	}
+
+	device := checker.config.Device
+	log.Infof("Checking %s", device)
+	release, err := CheckRelease(checker.config.ReleaseURL, device)
+	if err != nil {
+		return err
+	}
+	log.Infof("Official release timestamp %d, built release timestamp %d", release.Official, release.Built)
+	if !force && !release.UpdateAvailable() {
+		log.Infof("No new release of %s", device)
+		if deferred {
+			// built in the meantime
+			return checker.clearDeferredBuild()
+		}
+		return nil
+	}
+	if !force && !checker.config.BuildWindow.InWindow(time.Now()) {
+		return checker.deferBuild(release.Official)
+	}
+
+	active, err := checker.activeBuild()
+	if err != nil {
+		return err
+	}
+	if active != "" {
+		log.Infof("Not starting another build of %s while %s is building", device, active)
+		return nil
+	}
+	token, locked, err := checker.lockBuild("spot")
+	if err != nil {
+		return err
+	}
+	if !locked {
+		log.Infof("Not starting another build of %s, the build lock %s is held", device, BuildLockID(checker.config.Name))
+		return nil
+	}
+	log.Infof("Spinning up %s release", device)
+	if err := checker.requestSpotBuild(checker.config.SpotPrice, "spot", token); err != nil {
+		checker.unlockBuild(token)
+		return err
+	}
+	if deferred {
+		return checker.clearDeferredBuild()
+	}
+	return nil
+}
+
+func (checker *Checker) deferredBuildPending() (bool, error) {
+	_, err := checker.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &checker.config.Name,
+		Key:    aws.String(deferredBuildKey),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return false, nil
+		}
+		return false, fmt.Errorf("Failed to check for deferred build: %v", err)
+	}
+	return true, nil
+}
+
+func (checker *Checker) deferBuild(officialTimestamp int64) error {
+	pending, err := checker.deferredBuildPending()
+	if err != nil {
+		return err
+	}
+	_, err = checker.s3Client.PutObject(&s3.PutObjectInput{
+		Bucket: &checker.config.Name,
+		Key:    aws.String(deferredBuildKey),
+		Body:   bytes.NewReader([]byte(strconv.FormatInt(officialTimestamp, 10))),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to defer build: %v", err)
+	}
+	log.Infof("Release %d found outside of build window, deferring build", officialTimestamp)
+	if pending {
+		return nil
+	}
+	return checker.notify(fmt.Sprintf("New CopperheadOS release found for %s, build deferred until the next build window", checker.config.Device))
+}
+
+func (checker *Checker) clearDeferredBuild() error {
+	_, err := checker.s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &checker.config.Name,
+		Key:    aws.String(deferredBuildKey),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to clear deferred build: %v", err)
+	}
+	return nil
+}
+
+func (checker *Checker) fleetRole() string {
+	return fmt.Sprintf("arn:aws:iam::%s:role/%s-spot-fleet-role", checker.accountID, checker.config.Name)
+}
+
+func (checker *Checker) instanceProfile() string {
+	return fmt.Sprintf("arn:aws:iam::%s:instance-profile/%s-ec2", checker.accountID, checker.config.Name)
+}
+
+func (checker *Checker) tags() []*ec2.Tag {
+	return []*ec2.Tag{
+		{Key: aws.String("chos:stack"), Value: aws.String(checker.config.Name)},
+		{Key: aws.String("chos:device"), Value: aws.String(checker.config.Device)},
+		{Key: aws.String("chos:version"), Value: aws.String(checker.config.Version)},
+	}
+}
+
+// requestSpotBuild requests a spot fleet for a build. The build instance
+// releases the build lock held with lockToken when it is done.
+func (checker *Checker) requestSpotBuild(spotPrice, launchPath, lockToken string) error {
+	candidates, err := checker.spotCandidates(spotPrice)
+	if err != nil {
+		return err
+	}
+	output, err := checker.ec2Client.RequestSpotFleet(checker.spotFleetRequest(time.Now(), spotPrice, launchPath, lockToken, candidates))
+	if err != nil {
+		return fmt.Errorf("Failed to request spot fleet: %v", err)
+	}
+	log.Infof("Requested spot fleet %s at %s", aws.StringValue(output.SpotFleetRequestId), spotPrice)
+	return nil
+}
+
+// spotCandidates ranks the instance types in the availability zones of the
+// stack and returns the best ones currently below spotPrice. When none are,
+// the best ones are returned anyway and the fleet waits for the price to drop.
+func (checker *Checker) spotCandidates(spotPrice string) ([]SpotCandidate, error) {
+	output, err := checker.ec2Client.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: aws.StringSlice(checker.config.SubnetIDs),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to describe subnets: %v", err)
+	}
+	subnets := map[string]string{}
+	for _, subnet := range output.Subnets {
+		subnets[aws.StringValue(subnet.AvailabilityZone)] = aws.StringValue(subnet.SubnetId)
+	}
+
+	ranked, err := RankSpotCandidates(checker.ec2Client, checker.config.Region, checker.config.InstanceTypes, subnets)
+	if err != nil {
+		return nil, err
+	}
+	maxPrice, err := strconv.ParseFloat(spotPrice, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid spot price %s: %v", spotPrice, err)
+	}
+	candidates := []SpotCandidate{}
+	for _, candidate := range ranked {
+		if candidate.Price <= maxPrice {
+			candidates = append(candidates, candidate)
+		}
+	}
+	if len(candidates) == 0 {
+		log.Warnf("No instance type is currently available below $%s", spotPrice)
+		candidates = ranked
+	}
+	if len(candidates) > maxFleetCandidates {
+		candidates = candidates[:maxFleetCandidates]
+	}
+	for _, candidate := range candidates {
+		log.Infof("Candidate %s in %s at $%.4f ($%.4f per vCPU), interrupted %s", candidate.InstanceType, candidate.Zone,
+			candidate.Price, candidate.PricePerVCPU(), candidate.InterruptionLabel)
+	}
+	return candidates, nil
+}
+
+// spotFleetRequest asks for a single build instance, which is terminated
+// after the maximum build duration. The capacity of each candidate is
+// weighted by its vCPUs, so the fleet picks the lowest price per vCPU, and
+// any single instance fulfills it. The price of a weighted candidate is per
+// vCPU, so each instance is capped at spotPrice. Without candidates the fleet
+// picks the cheapest of the instance types in any zone of the stack.
+func (checker *Checker) spotFleetRequest(now time.Time, spotPrice, launchPath, lockToken string, candidates []SpotCandidate) *ec2.RequestSpotFleetInput {
+	now = now.UTC().Truncate(time.Second)
+	userData := base64.StdEncoding.EncodeToString([]byte(checker.userData(launchPath, lockToken, 0)))
+	specification := func(instanceType, subnetID string) *ec2.SpotFleetLaunchSpecification {
+		specification := &ec2.SpotFleetLaunchSpecification{
+			ImageId:             aws.String(checker.config.AMI),
+			SubnetId:            aws.String(subnetID),
+			SecurityGroups:      []*ec2.GroupIdentifier{{GroupId: aws.String(checker.config.SecurityGroupID)}},
+			InstanceType:        aws.String(instanceType),
+			IamInstanceProfile:  &ec2.IamInstanceProfileSpecification{Arn: aws.String(checker.instanceProfile())},
+			BlockDeviceMappings: checker.blockDeviceMappings(),
+			TagSpecifications: []*ec2.SpotFleetTagSpecification{
+				{ResourceType: aws.String(ec2.ResourceTypeInstance), Tags: checker.tags()},
+			},
+			UserData: aws.String(userData),
+		}
+		if checker.config.SSHKey != "" {
+			specification.KeyName = aws.String(checker.config.SSHKey)
+		}
+		return specification
+	}
+
+	request := &ec2.SpotFleetRequestConfigData{
+		IamFleetRole:                     aws.String(checker.fleetRole()),
+		AllocationStrategy:               aws.String(ec2.AllocationStrategyLowestPrice),
+		ValidFrom:                        aws.Time(now),
+		ValidUntil:                       aws.Time(now.Add(time.Duration(checker.config.MaxBuildSeconds) * time.Second)),
+		TerminateInstancesWithExpiration: aws.Bool(true),
+		Type:                             aws.String(ec2.FleetTypeRequest),
+	}
+	if len(candidates) == 0 {
+		for _, instanceType := range checker.config.InstanceTypes {
+			request.LaunchSpecifications = append(request.LaunchSpecifications,
+				specification(instanceType, strings.Join(checker.config.SubnetIDs, ",")))
+		}
+		request.TargetCapacity = aws.Int64(1)
+		request.SpotPrice = aws.String(spotPrice)
+		return &ec2.RequestSpotFleetInput{SpotFleetRequestConfig: request}
+	}
+
+	price, _ := strconv.ParseFloat(spotPrice, 64)
+	capacity := candidates[0].VCPUs
+	for _, candidate := range candidates {
+		weighted := specification(candidate.InstanceType, candidate.SubnetID)
+		weighted.WeightedCapacity = aws.Float64(float64(candidate.VCPUs))
+		weighted.SpotPrice = aws.String(strconv.FormatFloat(price/float64(candidate.VCPUs), 'f', 5, 64))
+		request.LaunchSpecifications = append(request.LaunchSpecifications, weighted)
+		if candidate.VCPUs < capacity {
+			capacity = candidate.VCPUs
+		}
+	}
+	request.TargetCapacity = aws.Int64(int64(capacity))
+	return &ec2.RequestSpotFleetInput{SpotFleetRequestConfig: request}
+}
+
+// fleetPrice is the price a spot fleet was requested at per instance.
+func fleetPrice(fleet *ec2.SpotFleetRequestConfig) string {
+	config := fleet.SpotFleetRequestConfig
+	if len(config.LaunchSpecifications) > 0 {
+		weighted := config.LaunchSpecifications[0]
+		if weighted.SpotPrice != nil && weighted.WeightedCapacity != nil {
+			price, err := strconv.ParseFloat(aws.StringValue(weighted.SpotPrice), 64)
+			if err == nil {
+				return strconv.FormatFloat(price*aws.Float64Value(weighted.WeightedCapacity), 'f', 4, 64)
+			}
+		}
+	}
+	return aws.StringValue(config.SpotPrice)
+}
+
+// fleetToken is the token of the build lock a spot fleet was launched with,
+// which its user data passes to the build script.
+func fleetToken(fleet *ec2.SpotFleetRequestConfig) string {
+	specifications := fleet.SpotFleetRequestConfig.LaunchSpecifications
+	if len(specifications) == 0 {
+		return ""
+	}
+	userData, err := base64.StdEncoding.DecodeString(aws.StringValue(specifications[0].UserData))
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(userData))
+	for i, field := range fields {
+		if field == "-L" && i+1 < len(fields) {
+			return strings.Trim(fields[i+1], `"`)
+		}
+	}
+	return ""
+}
+
+func (checker *Checker) blockDeviceMappings() []*ec2.BlockDeviceMapping {
+	return []*ec2.BlockDeviceMapping{{
+		DeviceName: aws.String("/dev/sda1"),
+		Ebs: &ec2.EbsBlockDevice{
+			DeleteOnTermination: aws.Bool(true),
+			VolumeSize:          aws.Int64(checker.config.VolumeSize),
+			VolumeType:          aws.String(checker.config.VolumeType),
+		},
+	}}
+}
+
+// requestOnDemandBuild starts a build on an on-demand instance of the
+// preferred instance type. On-demand instances have no ValidUntil, so the
+// instance has to enforce the build duration itself.
+func (checker *Checker) requestOnDemandBuild(lockToken string) error {
+	input := &ec2.RunInstancesInput{
+		MinCount:                          aws.Int64(1),
+		MaxCount:                          aws.Int64(1),
+		InstanceInitiatedShutdownBehavior: aws.String(ec2.ShutdownBehaviorTerminate),
+		ImageId:                           aws.String(checker.config.AMI),
+		SubnetId:                          aws.String(checker.config.SubnetIDs[0]),
+		SecurityGroupIds:                  []*string{aws.String(checker.config.SecurityGroupID)},
+		InstanceType:                      aws.String(checker.config.InstanceTypes[0]),
+		IamInstanceProfile:                &ec2.IamInstanceProfileSpecification{Arn: aws.String(checker.instanceProfile())},
+		BlockDeviceMappings:               checker.blockDeviceMappings(),
+		TagSpecifications: []*ec2.TagSpecification{
+			{ResourceType: aws.String(ec2.ResourceTypeInstance), Tags: checker.tags()},
+			{ResourceType: aws.String(ec2.ResourceTypeVolume), Tags: checker.tags()},
+		},
+		// as for spot fleet launch specifications, the sdk expects encoded user data
+		UserData: aws.String(base64.StdEncoding.EncodeToString([]byte(checker.userData("on-demand", lockToken, checker.config.MaxBuildSeconds)))),
+	}
+	if checker.config.SSHKey != "" {
+		input.KeyName = aws.String(checker.config.SSHKey)
+	}
+	output, err := checker.ec2Client.RunInstances(input)
+	if err != nil {
+		return fmt.Errorf("Failed to start on-demand instance: %v", err)
+	}
+	log.Infof("Started on-demand instance %s", aws.StringValue(output.Instances[0].InstanceId))
+	return nil
+}
+
+// checkFallback applies the fallback policy to spot fleets of the stack that
+// haven't been fulfilled within the fallback time.
+func (checker *Checker) checkFallback() error {
+	fleets, err := checker.unfulfilledFleets()
+	if err != nil {
+		return err
+	}
+	fallback := time.Duration(checker.config.FallbackSeconds) * time.Second
+	for _, fleet := range fleets {
+		fleetID := aws.StringValue(fleet.SpotFleetRequestId)
+		age := time.Since(aws.TimeValue(fleet.CreateTime))
+		if age < fallback {
+			continue
+		}
+		price := fleetPrice(fleet)
+		log.Infof("Spot fleet %s at %s not fulfilled after %s", fleetID, price, age.Round(time.Second))
+
+		raised, canRaise := raisePrice(price, checker.config.MaxSpotPrice)
+		token := fleetToken(fleet)
+		if token == "" && (checker.config.FallbackPolicy == FallbackOnDemand || checker.config.FallbackPolicy == FallbackRaisePrice && canRaise) {
+			log.Warnf("Not falling back for spot fleet %s, it wasn't launched with a build lock token", fleetID)
+			continue
+		}
+		switch {
+		case checker.config.FallbackPolicy == FallbackOnDemand:
+			locked, lockErr := checker.relockBuild("on-demand", token)
+			if lockErr != nil {
+				return lockErr
+			}
+			if !locked {
+				log.Warnf("Not falling back for spot fleet %s, another build holds the build lock", fleetID)
+				continue
+			}
+			if err := checker.cancelFleet(fleetID); err != nil {
+				return err
+			}
+			if err := checker.requestOnDemandBuild(token); err != nil {
+				return err
+			}
+			err = checker.notify(fmt.Sprintf("CopperheadOS spot request %s at $%s was not fulfilled, falling back to on-demand build", fleetID, price))
+		case checker.config.FallbackPolicy == FallbackRaisePrice && canRaise:
+			locked, lockErr := checker.relockBuild("spot-raised", token)
+			if lockErr != nil {
+				return lockErr
+			}
+			if !locked {
+				log.Warnf("Not falling back for spot fleet %s, another build holds the build lock", fleetID)
+				continue
+			}
+			if err := checker.cancelFleet(fleetID); err != nil {
+				return err
+			}
+			if err := checker.requestSpotBuild(raised, "spot-raised", token); err != nil {
+				return err
+			}
+			err = checker.notify(fmt.Sprintf("CopperheadOS spot request %s at $%s was not fulfilled, retrying at $%s", fleetID, price, raised))
+		case age < fallback+fallbackCheckInterval:
+			// only notify on the first check after the fallback time passed
+			err = checker.notify(fmt.Sprintf("CopperheadOS spot request %s at $%s has not been fulfilled, build is still waiting for capacity", fleetID, price))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// raisePrice raises a spot price by half, up to maxPrice. It reports false
+// when the price can't be raised any further.
+func raisePrice(price, maxPrice string) (string, bool) {
+	current, err := strconv.ParseFloat(price, 64)
+	if err != nil {
+		return "", false
+	}
+	ceiling, err := strconv.ParseFloat(maxPrice, 64)
+	if err != nil || current >= ceiling {
+		return "", false
+	}
+	raised := current * 1.5
+	if raised > ceiling {
+		raised = ceiling
+	}
+	return strconv.FormatFloat(raised, 'f', 4, 64), true
+}
+
+// unfulfilledFleets returns the open spot fleets of the stack, recognized by
+// their fleet role, that have no instance yet.
+func (checker *Checker) unfulfilledFleets() ([]*ec2.SpotFleetRequestConfig, error) {
+	fleets := []*ec2.SpotFleetRequestConfig{}
+	input := &ec2.DescribeSpotFleetRequestsInput{}
+	for {
+		output, err := checker.ec2Client.DescribeSpotFleetRequests(input)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to describe spot fleets: %v", err)
+		}
+		for _, fleet := range output.SpotFleetRequestConfigs {
+			if aws.StringValue(fleet.SpotFleetRequestConfig.IamFleetRole) != checker.fleetRole() {
+				continue
+			}
+			state := aws.StringValue(fleet.SpotFleetRequestState)
+			if state != ec2.BatchStateSubmitted && state != ec2.BatchStateActive {
+				continue
+			}
+			instances, err := checker.ec2Client.DescribeSpotFleetInstances(&ec2.DescribeSpotFleetInstancesInput{
+				SpotFleetRequestId: fleet.SpotFleetRequestId,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("Failed to describe instances of spot fleet %s: %v", aws.StringValue(fleet.SpotFleetRequestId), err)
+			}
+			if len(instances.ActiveInstances) == 0 {
+				fleets = append(fleets, fleet)
+			}
+		}
+		if aws.StringValue(output.NextToken) == "" {
+			return fleets, nil
+		}
+		input.NextToken = output.NextToken
+	}
+}
+
+func (checker *Checker) cancelFleet(fleetID string) error {
+	log.Infof("Cancelling spot fleet %s", fleetID)
+	_, err := checker.ec2Client.CancelSpotFleetRequests(&ec2.CancelSpotFleetRequestsInput{
+		SpotFleetRequestIds: []*string{aws.String(fleetID)},
+		TerminateInstances:  aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to cancel spot fleet %s: %v", fleetID, err)
+	}
+	return nil
+}
+
+func (checker *Checker) notify(message string) error {
+	log.Info(message)
+	_, err := checker.snsClient.Publish(&sns.PublishInput{
+		TopicArn: aws.String(checker.config.TopicARN),
+		Message:  aws.String(message),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to publish notification: %v", err)
+	}
+	return nil
+}
+
+// userData is the cloud-init config of a build instance, which downloads and
+// runs the build script of the stack with the token of the build lock it
+// releases. Instances shut down after maxBuildSeconds if it is set. The script
+// is downloaded from an S3 compatible service with its credentials from SSM.
+func (checker *Checker) userData(launchPath, lockToken string, maxBuildSeconds int64) string {
+	shutdownCmd := ""
+	if maxBuildSeconds > 0 && !checker.config.PreventShutdown {
+		shutdownCmd = fmt.Sprintf(`- [ bash, -c, "shutdown -h +%d" ]`, maxBuildSeconds/60)
+	}
+	copyCmd := "aws s3 cp"
+	if checker.config.S3Endpoint != "" {
+		parameter := "$(aws --region %s ssm get-parameter --name %s --with-decryption --query Parameter.Value --output text)"
+		copyCmd = fmt.Sprintf(`env AWS_ACCESS_KEY_ID=\"%s\" AWS_SECRET_ACCESS_KEY=\"%s\" aws s3 cp --endpoint-url %s`,
+			fmt.Sprintf(parameter, checker.config.Region, S3EndpointKeyIDParameter(checker.config.Name)),
+			fmt.Sprintf(parameter, checker.config.Region, S3EndpointSecretParameter(checker.config.Name)),
+			checker.config.S3Endpoint)
+	}
+	scriptPath := fmt.Sprintf("s3://%s-script/chos.sh", checker.config.Name)
+
+	return fmt.Sprintf(`
+    #cloud-config
+    output : { all : '| tee -a /var/log/cloud-init-output.log' }
+
+    repo_update: true
+    repo_upgrade: all
+    packages:
+    - awscli
+    - jq
+
+    runcmd:
+    %s
+    - [ bash, -c, "sudo -u ubuntu %s %s /home/ubuntu/chos.sh" ]
+    - [ bash, -c, "sudo -u ubuntu bash /home/ubuntu/chos.sh %s -A -l %s -L %s" ]
+    `, shutdownCmd, copyCmd, scriptPath, checker.config.Device, launchPath, lockToken)
+}
@@ -0,0 +1,219 @@
+package checker
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+func testChecker() *Checker {
+	return &Checker{
+		config: &Config{
+			Name:            "chos",
+			Device:          "marlin",
+			AMI:             "ami-1",
+			InstanceTypes:   []string{"c5.4xlarge", "c4.4xlarge"},
+			VolumeSize:      200,
+			VolumeType:      "gp2",
+			MaxBuildSeconds: 43200,
+			SubnetIDs:       []string{"subnet-a", "subnet-b"},
+			SecurityGroupID: "sg-1",
+		},
+		accountID: "123456789012",
+	}
+}
+
+func TestRaisePrice(t *testing.T) {
+	tests := []struct {
+		price    string
+		maxPrice string
+		want     string
+		raised   bool
+	}{
+		{"0.4", "1.00", "0.6000", true},
+		{"0.8", "1.00", "1.0000", true},
+		{"1.00", "1.00", "", false},
+		{"1.20", "1.00", "", false},
+		{"invalid", "1.00", "", false},
+		{"0.4", "", "", false},
+	}
+	for _, test := range tests {
+		got, raised := raisePrice(test.price, test.maxPrice)
+		if got != test.want || raised != test.raised {
+			t.Errorf("raise %q up to %q: got %q %v, want %q %v", test.price, test.maxPrice, got, raised, test.want, test.raised)
+		}
+	}
+}
+
+func TestSpotFleetRequest(t *testing.T) {
+	checker := testChecker()
+	now := time.Date(2018, 6, 1, 12, 0, 0, 500, time.FixedZone("UTC+2", 2*3600))
+	candidates := []SpotCandidate{
+		{InstanceType: "c5.4xlarge", SubnetID: "subnet-b", Price: 0.64, VCPUs: 16},
+		{InstanceType: "c5.9xlarge", SubnetID: "subnet-a", Price: 1.44, VCPUs: 36},
+	}
+	request := checker.spotFleetRequest(now, "1.00", "spot", "token", candidates).SpotFleetRequestConfig
+
+	if want := time.Date(2018, 6, 1, 22, 0, 0, 0, time.UTC); !aws.TimeValue(request.ValidUntil).Equal(want) {
+		t.Errorf("got valid until %s, want %s", aws.TimeValue(request.ValidUntil), want)
+	}
+	if request.SpotPrice != nil {
+		t.Errorf("got fleet price %s, want price per launch specification", aws.StringValue(request.SpotPrice))
+	}
+	if got := aws.Int64Value(request.TargetCapacity); got != 16 {
+		t.Errorf("got target capacity %d, want 16", got)
+	}
+	if len(request.LaunchSpecifications) != len(candidates) {
+		t.Fatalf("got %d launch specifications, want %d", len(request.LaunchSpecifications), len(candidates))
+	}
+	for i, want := range []struct {
+		instanceType string
+		subnetID     string
+		weight       float64
+		price        string
+	}{
+		{"c5.4xlarge", "subnet-b", 16, "0.06250"},
+		{"c5.9xlarge", "subnet-a", 36, "0.02778"},
+	} {
+		specification := request.LaunchSpecifications[i]
+		if aws.StringValue(specification.InstanceType) != want.instanceType ||
+			aws.StringValue(specification.SubnetId) != want.subnetID ||
+			aws.Float64Value(specification.WeightedCapacity) != want.weight ||
+			aws.StringValue(specification.SpotPrice) != want.price {
+			t.Errorf("launch specification %d: got %s in %s weighted %v at %s, want %s in %s weighted %v at %s", i,
+				aws.StringValue(specification.InstanceType), aws.StringValue(specification.SubnetId),
+				aws.Float64Value(specification.WeightedCapacity), aws.StringValue(specification.SpotPrice),
+				want.instanceType, want.subnetID, want.weight, want.price)
+		}
+		checkUserData(t, specification, "spot", "token")
+	}
+	if got := fleetPrice(&ec2.SpotFleetRequestConfig{SpotFleetRequestConfig: request}); got != "1.0000" {
+		t.Errorf("got fleet price %s, want 1.0000", got)
+	}
+}
+
+func TestSpotFleetRequestWithoutCandidates(t *testing.T) {
+	checker := testChecker()
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	request := checker.spotFleetRequest(now, "1.00", "raise-price", "token", nil).SpotFleetRequestConfig
+
+	if got := aws.StringValue(request.SpotPrice); got != "1.00" {
+		t.Errorf("got fleet price %s, want 1.00", got)
+	}
+	if got := aws.Int64Value(request.TargetCapacity); got != 1 {
+		t.Errorf("got target capacity %d, want 1", got)
+	}
+	if len(request.LaunchSpecifications) != len(checker.config.InstanceTypes) {
+		t.Fatalf("got %d launch specifications, want %d", len(request.LaunchSpecifications), len(checker.config.InstanceTypes))
+	}
+	for i, specification := range request.LaunchSpecifications {
+		if got := aws.StringValue(specification.InstanceType); got != checker.config.InstanceTypes[i] {
+			t.Errorf("launch specification %d: got instance type %s, want %s", i, got, checker.config.InstanceTypes[i])
+		}
+		if got := aws.StringValue(specification.SubnetId); got != "subnet-a,subnet-b" {
+			t.Errorf("launch specification %d: got subnets %s, want subnet-a,subnet-b", i, got)
+		}
+		if specification.WeightedCapacity != nil || specification.SpotPrice != nil {
+			t.Errorf("launch specification %d: got weighted launch specification", i)
+		}
+		checkUserData(t, specification, "raise-price", "token")
+	}
+	if got := fleetPrice(&ec2.SpotFleetRequestConfig{SpotFleetRequestConfig: request}); got != "1.00" {
+		t.Errorf("got fleet price %s, want 1.00", got)
+	}
+}
+
+func checkUserData(t *testing.T, specification *ec2.SpotFleetLaunchSpecification, launchPath, lockToken string) {
+	userData, err := base64.StdEncoding.DecodeString(aws.StringValue(specification.UserData))
+	if err != nil {
+		t.Errorf("failed to decode user data: %v", err)
+		return
+	}
+	if want := "chos.sh marlin -A -l " + launchPath + " -L " + lockToken; !strings.Contains(string(userData), want) {
+		t.Errorf("user data doesn't run %q:\n%s", want, userData)
+	}
+	if strings.Contains(string(userData), "shutdown") {
+		t.Errorf("user data of a spot build shuts down the instance:\n%s", userData)
+	}
+}
+
+func TestConfigFromVariables(t *testing.T) {
+	variables := map[string]string{
+		ConfigEnv:          `{"name": "chos", "device": "marlin", "instance_types": ["c5.4xlarge"], "build_window": {"start": 60, "end": 300}}`,
+		SubnetIDsEnv:       "subnet-a,subnet-b",
+		SecurityGroupIDEnv: "sg-1",
+		TopicARNEnv:        "arn:aws:sns:us-west-2:123456789012:chos",
+	}
+	config, err := ConfigFromVariables(variables)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Name != "chos" || config.Device != "marlin" || len(config.InstanceTypes) != 1 {
+		t.Errorf("got config %+v", config)
+	}
+	if config.BuildWindow == nil || config.BuildWindow.Start != 60 || config.BuildWindow.End != 300 {
+		t.Errorf("got build window %+v, want 60 to 300", config.BuildWindow)
+	}
+	if len(config.SubnetIDs) != 2 || config.SubnetIDs[0] != "subnet-a" || config.SubnetIDs[1] != "subnet-b" {
+		t.Errorf("got subnets %v, want [subnet-a subnet-b]", config.SubnetIDs)
+	}
+	if config.SecurityGroupID != "sg-1" || config.TopicARN != variables[TopicARNEnv] {
+		t.Errorf("got security group %s and topic %s", config.SecurityGroupID, config.TopicARN)
+	}
+
+	for _, name := range []string{ConfigEnv, SubnetIDsEnv, SecurityGroupIDEnv, TopicARNEnv} {
+		missing := map[string]string{}
+		for key, value := range variables {
+			if key != name {
+				missing[key] = value
+			}
+		}
+		if _, err := ConfigFromVariables(missing); err == nil {
+			t.Errorf("expected an error without %s", name)
+		}
+	}
+	variables[ConfigEnv] = "{"
+	if _, err := ConfigFromVariables(variables); err == nil {
+		t.Errorf("expected an error for an invalid %s", ConfigEnv)
+	}
+}
+
+func TestFleetToken(t *testing.T) {
+	checker := testChecker()
+	request := checker.spotFleetRequest(time.Now(), "1.00", "spot", "1528000000000000000", nil)
+	fleet := &ec2.SpotFleetRequestConfig{SpotFleetRequestConfig: request.SpotFleetRequestConfig}
+	if got := fleetToken(fleet); got != "1528000000000000000" {
+		t.Errorf("got token %q, want 1528000000000000000", got)
+	}
+	fleet.SpotFleetRequestConfig.LaunchSpecifications[0].UserData = aws.String(base64.StdEncoding.EncodeToString([]byte("#cloud-config")))
+	if got := fleetToken(fleet); got != "" {
+		t.Errorf("got token %q without a token in the user data", got)
+	}
+	if got := fleetToken(&ec2.SpotFleetRequestConfig{SpotFleetRequestConfig: &ec2.SpotFleetRequestConfigData{}}); got != "" {
+		t.Errorf("got token %q without launch specifications", got)
+	}
+}
+
+func TestUserDataS3Endpoint(t *testing.T) {
+	checker := testChecker()
+	if userData := checker.userData("spot", "token", 0); strings.Contains(userData, "ssm") || !strings.Contains(userData, "aws s3 cp s3://chos-script/chos.sh") {
+		t.Errorf("user data without s3 endpoint:\n%s", userData)
+	}
+
+	checker.config.Region = "us-west-2"
+	checker.config.S3Endpoint = "https://minio.example.org"
+	userData := checker.userData("spot", "token", 0)
+	for _, want := range []string{
+		"--endpoint-url https://minio.example.org s3://chos-script/chos.sh",
+		`AWS_ACCESS_KEY_ID=\"$(aws --region us-west-2 ssm get-parameter --name /chos/s3-endpoint/access-key-id --with-decryption`,
+		`AWS_SECRET_ACCESS_KEY=\"$(aws --region us-west-2 ssm get-parameter --name /chos/s3-endpoint/secret-access-key --with-decryption`,
+	} {
+		if !strings.Contains(userData, want) {
+			t.Errorf("user data doesn't contain %q:\n%s", want, userData)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package checker decides whether a stack has to build a new release and
+// starts the build. It runs in the build checker Lambda function of a stack,
+// with the copperheados-stack binary as a custom runtime, and in the build
+// and status commands, so both always come to the same decision.
+package checker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables the build checker Lambda function is configured with
+const (
+	ConfigEnv          = "CHECKER_CONFIG"
+	SubnetIDsEnv       = "SUBNET_IDS"
+	SecurityGroupIDEnv = "SECURITY_GROUP_ID"
+	TopicARNEnv        = "SNS_TOPIC_ARN"
+)
+
+// S3EndpointKeyIDParameter and S3EndpointSecretParameter are the SSM
+// parameters holding the credentials of the S3 compatible service of a stack.
+// Build instances and the build checker access the service with them, as it
+// doesn't accept the credentials of their roles.
+func S3EndpointKeyIDParameter(name string) string {
+	return "/" + name + "/s3-endpoint/access-key-id"
+}
+
+func S3EndpointSecretParameter(name string) string {
+	return "/" + name + "/s3-endpoint/secret-access-key"
+}
+
+// Window restricts the time of day (UTC) builds are allowed to start. Start
+// and End are minutes since midnight and the window wraps around midnight
+// when End is before Start.
+type Window struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Config is what the checker needs to know about a stack. The parts known
+// before the stack is provisioned are rendered as JSON into ConfigEnv, the ids
+// of the network and topic are added from their own variables.
+type Config struct {
+	Name            string   `json:"name"`
+	Region          string   `json:"region"`
+	Device          string   `json:"device"`
+	Version         string   `json:"version"`
+	AMI             string   `json:"ami"`
+	SSHKey          string   `json:"ssh_key"`
+	SpotPrice       string   `json:"spot_price"`
+	InstanceTypes   []string `json:"instance_types"`
+	VolumeSize      int64    `json:"volume_size"`
+	VolumeType      string   `json:"volume_type"`
+	MaxBuildSeconds int64    `json:"max_build_seconds"`
+	PreventShutdown bool     `json:"prevent_shutdown"`
+	FallbackPolicy  string   `json:"fallback_policy"`
+	FallbackSeconds int64    `json:"fallback_seconds"`
+	MaxSpotPrice    string   `json:"max_spot_price"`
+	BuildWindow     *Window  `json:"build_window"`
+	ReleaseURL      string   `json:"release_url"`
+	S3Endpoint      string   `json:"s3_endpoint"`
+
+	SubnetIDs       []string `json:"-"`
+	SecurityGroupID string   `json:"-"`
+	TopicARN        string   `json:"-"`
+}
+
+// ConfigFromVariables reads the config from the environment variables of the
+// build checker Lambda function.
+func ConfigFromVariables(variables map[string]string) (*Config, error) {
+	config := &Config{}
+	if err := json.Unmarshal([]byte(variables[ConfigEnv]), config); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s: %v", ConfigEnv, err)
+	}
+	if variables[SubnetIDsEnv] != "" {
+		config.SubnetIDs = strings.Split(variables[SubnetIDsEnv], ",")
+	}
+	config.SecurityGroupID = variables[SecurityGroupIDEnv]
+	config.TopicARN = variables[TopicARNEnv]
+	if len(config.SubnetIDs) == 0 || config.SecurityGroupID == "" || config.TopicARN == "" {
+		return nil, fmt.Errorf("Missing %s, %s or %s", SubnetIDsEnv, SecurityGroupIDEnv, TopicARNEnv)
+	}
+	return config, nil
+}
+
+// ConfigFromEnv reads the config from the environment of the running Lambda
+// function.
+func ConfigFromEnv() (*Config, error) {
+	variables := map[string]string{}
+	for _, name := range []string{ConfigEnv, SubnetIDsEnv, SecurityGroupIDEnv, TopicARNEnv} {
+		variables[name] = os.Getenv(name)
+	}
+	return ConfigFromVariables(variables)
+}
@@ -0,0 +1,101 @@
+package checker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runtimeAPIEnv is set by Lambda for custom runtimes, see
+// https://docs.aws.amazon.com/lambda/latest/dg/runtimes-api.html
+const runtimeAPIEnv = "AWS_LAMBDA_RUNTIME_API"
+
+// event is what the schedules of a stack invoke the checker with
+type event struct {
+	Action string `json:"action"`
+}
+
+// InLambda reports whether the binary runs as the custom runtime of a Lambda
+// function.
+func InLambda() bool {
+	return os.Getenv(runtimeAPIEnv) != ""
+}
+
+// ServeLambda handles invocations of the build checker Lambda function until
+// the function is shut down.
+func ServeLambda() error {
+	log.SetFormatter(&log.TextFormatter{DisableTimestamp: true})
+	config, err := ConfigFromEnv()
+	if err != nil {
+		return initError(err)
+	}
+	checker, err := New(config)
+	if err != nil {
+		return initError(err)
+	}
+
+	api := "http://" + os.Getenv(runtimeAPIEnv) + "/2018-06-01/runtime"
+	// invocations have no timeout, the runtime is frozen in between
+	client := &http.Client{}
+	for {
+		resp, err := client.Get(api + "/invocation/next")
+		if err != nil {
+			return fmt.Errorf("Failed to get next invocation: %v", err)
+		}
+		requestID := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to read invocation %s: %v", requestID, err)
+		}
+
+		invocation := event{}
+		// scheduled checks are invoked with an event of CloudWatch Events, which has no action
+		err = json.Unmarshal(body, &invocation)
+		if err == nil {
+			err = checker.Run(invocation.Action, false)
+		}
+		if err != nil {
+			log.Errorf("Invocation %s failed: %v", requestID, err)
+			err = post(client, api+"/invocation/"+requestID+"/error", errorResponse(err))
+		} else {
+			err = post(client, api+"/invocation/"+requestID+"/response", []byte("null"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func initError(err error) error {
+	api := "http://" + os.Getenv(runtimeAPIEnv) + "/2018-06-01/runtime"
+	if postErr := post(http.DefaultClient, api+"/init/error", errorResponse(err)); postErr != nil {
+		log.Error(postErr)
+	}
+	return err
+}
+
+func errorResponse(err error) []byte {
+	body, _ := json.Marshal(map[string]string{
+		"errorMessage": err.Error(),
+		"errorType":    "CheckerError",
+	})
+	return body
+}
+
+func post(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Failed to post to %s: %v", url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Failed to post to %s: %s", url, resp.Status)
+	}
+	return nil
+}
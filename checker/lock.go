@@ -0,0 +1,170 @@
+package checker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+)
+
+// LockTableName is the DynamoDB table terraform uses to lock the stack state,
+// which also holds the build lock.
+func LockTableName(name string) string {
+	return name + "-terraform-lock"
+}
+
+// BuildLockID is the item of the lock table that is held while a build of the
+// stack is requested or running. The build instance deletes it when the build
+// is done.
+func BuildLockID(name string) string {
+	return name + "/build"
+}
+
+// buildLease is how long the build lock is held without being released. It
+// covers waiting for spot capacity until the fallback policy applies and the
+// longest possible build, so only crashed builds let it expire.
+func (checker *Checker) buildLease() time.Duration {
+	return time.Duration(checker.config.FallbackSeconds+checker.config.MaxBuildSeconds)*time.Second + fallbackCheckInterval
+}
+
+// activeBuild describes a build of the stack that is still running or waiting
+// for spot capacity, or returns an empty string when there is none. Instances
+// are recognized by their chos:stack tag and open spot fleets by their fleet
+// role, as fleet requests can't be tagged.
+func (checker *Checker) activeBuild() (string, error) {
+	instances, err := checker.ec2Client.DescribeInstances(&ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("tag:chos:stack"), Values: aws.StringSlice([]string{checker.config.Name})},
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{ec2.InstanceStateNamePending, ec2.InstanceStateNameRunning})},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to describe build instances: %v", err)
+	}
+	for _, reservation := range instances.Reservations {
+		for _, instance := range reservation.Instances {
+			return fmt.Sprintf("instance %s launched at %s", aws.StringValue(instance.InstanceId),
+				aws.TimeValue(instance.LaunchTime).UTC().Format(time.RFC3339)), nil
+		}
+	}
+
+	fleets, err := checker.unfulfilledFleets()
+	if err != nil {
+		return "", err
+	}
+	for _, fleet := range fleets {
+		return fmt.Sprintf("spot fleet %s requested at %s", aws.StringValue(fleet.SpotFleetRequestId),
+			aws.TimeValue(fleet.CreateTime).UTC().Format(time.RFC3339)), nil
+	}
+	return "", nil
+}
+
+// lockBuild takes the build lock for a build launched on launchPath and
+// returns the token the build instance releases it with. It reports false
+// when another build holds the lock, expired locks of crashed builds are
+// taken over.
+func (checker *Checker) lockBuild(launchPath string) (string, bool, error) {
+	now := time.Now()
+	token := strconv.FormatInt(now.UnixNano(), 10)
+	_, err := checker.dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName:                aws.String(LockTableName(checker.config.Name)),
+		Item:                     checker.buildLockItem(now, token, launchPath),
+		ConditionExpression:      aws.String("attribute_not_exists(LockID) OR #expires < :now"),
+		ExpressionAttributeNames: map[string]*string{"#expires": aws.String("Expires")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return "", false, nil
+		}
+		return "", false, fmt.Errorf("Failed to take build lock: %v", err)
+	}
+	return token, true, nil
+}
+
+// relockBuild renews the lease of the build lock when a fallback replaces a
+// build request that was launched with token, keeping the token so the
+// replacing instance can release the lock. A released lock is taken again. It
+// reports false when another build took the lock in the meantime.
+func (checker *Checker) relockBuild(launchPath, token string) (bool, error) {
+	now := time.Now()
+	_, err := checker.dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName:                 aws.String(LockTableName(checker.config.Name)),
+		Item:                      checker.buildLockItem(now, token, launchPath),
+		ConditionExpression:       aws.String("#token = :token OR attribute_not_exists(LockID)"),
+		ExpressionAttributeNames:  map[string]*string{"#token": aws.String("Token")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":token": {S: aws.String(token)}},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, fmt.Errorf("Failed to renew build lock: %v", err)
+	}
+	return true, nil
+}
+
+// unlockBuild releases the build lock if it is still held with token.
+func (checker *Checker) unlockBuild(token string) {
+	_, err := checker.dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:                 aws.String(LockTableName(checker.config.Name)),
+		Key:                       map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(BuildLockID(checker.config.Name))}},
+		ConditionExpression:       aws.String("#token = :token"),
+		ExpressionAttributeNames:  map[string]*string{"#token": aws.String("Token")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":token": {S: aws.String(token)}},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return
+		}
+		log.Warnf("Failed to release build lock, remove item %s from table %s: %v", BuildLockID(checker.config.Name), LockTableName(checker.config.Name), err)
+	}
+}
+
+func (checker *Checker) buildLockItem(now time.Time, token, launchPath string) map[string]*dynamodb.AttributeValue {
+	expires := now.Add(checker.buildLease())
+	info := fmt.Sprintf("%s build of %s at %s", launchPath, checker.config.Device, now.UTC().Format(time.RFC3339))
+	return map[string]*dynamodb.AttributeValue{
+		"LockID":  {S: aws.String(BuildLockID(checker.config.Name))},
+		"Token":   {S: aws.String(token)},
+		"Expires": {N: aws.String(strconv.FormatInt(expires.Unix(), 10))},
+		"Info":    {S: aws.String(info)},
+	}
+}
+
+// BuildLock describes the build lock of a stack, or returns an empty string
+// when it isn't held.
+func BuildLock(dynamoClient *dynamodb.DynamoDB, name string) (string, error) {
+	output, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(LockTableName(name)),
+		Key:       map[string]*dynamodb.AttributeValue{"LockID": {S: aws.String(BuildLockID(name))}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed to get build lock: %v", err)
+	}
+	if len(output.Item) == 0 {
+		return "", nil
+	}
+	expires := int64(0)
+	if attribute, ok := output.Item["Expires"]; ok {
+		expires, _ = strconv.ParseInt(aws.StringValue(attribute.N), 10, 64)
+	}
+	info := []string{}
+	if attribute, ok := output.Item["Info"]; ok {
+		info = append(info, aws.StringValue(attribute.S))
+	}
+	if expires < time.Now().Unix() {
+		info = append(info, "expired")
+	} else {
+		info = append(info, "expires "+time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+	return strings.Join(info, ", "), nil
+}
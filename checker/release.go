@@ -0,0 +1,105 @@
+package checker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OfficialURL serves the official CopperheadOS releases the stack follows.
+const OfficialURL = "https://release.copperhead.co"
+
+// officialURL and httpClient are variables so tests can serve releases
+// locally
+var (
+	officialURL = OfficialURL
+	httpClient  = &http.Client{Timeout: 30 * time.Second}
+)
+
+// Release compares the latest official release of a device with the latest
+// build of the stack.
+type Release struct {
+	Device string
+	// Official is the build timestamp of the latest official release
+	Official int64
+	// Built is the official build timestamp the stack last built, 0 when it
+	// hasn't built the device yet
+	Built int64
+}
+
+// UpdateAvailable reports whether there is an official release the stack
+// hasn't built yet.
+func (release Release) UpdateAvailable() bool {
+	return release.Built < release.Official
+}
+
+// CheckRelease fetches the timestamp of the latest official release of the
+// device, which is the second field of its stable channel, and the timestamp
+// of the official release the stack last built.
+func CheckRelease(releaseURL, device string) (*Release, error) {
+	official, found, err := fetch(officialURL + "/" + device + "-stable")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("No official release of %s found at %s", device, officialURL)
+	}
+	fields := strings.Fields(official)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("Unexpected official release metadata for %s: %q", device, official)
+	}
+	release := &Release{Device: device}
+	release.Official, err = strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected official release timestamp for %s: %v", device, err)
+	}
+
+	built, found, err := fetch(releaseURL + "/" + device + "-stable-true-timestamp")
+	if err != nil {
+		return nil, err
+	}
+	// the stack hasn't released the device yet, build it
+	if found {
+		release.Built, err = strconv.ParseInt(strings.TrimSpace(built), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unexpected release timestamp for %s at %s: %v", device, releaseURL, err)
+		}
+	}
+	return release, nil
+}
+
+// fetch returns the body of url. Any error status, like the 403 S3 answers
+// for missing objects of a public bucket, is reported as not found.
+func fetch(url string) (string, bool, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return "", false, fmt.Errorf("Failed to get %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", false, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", false, fmt.Errorf("Failed to read %s: %v", url, err)
+	}
+	return string(body), true, nil
+}
+
+// InWindow reports whether builds may start at t. Without a window they
+// always may.
+func (window *Window) InWindow(t time.Time) bool {
+	if window == nil {
+		return true
+	}
+	t = t.UTC()
+	minute := t.Hour()*60 + t.Minute()
+	if window.Start <= window.End {
+		return window.Start <= minute && minute < window.End
+	}
+	// window wraps around midnight
+	return minute >= window.Start || minute < window.End
+}
@@ -0,0 +1,178 @@
+package checker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveReleases serves the official releases and the release bucket of a
+// stack, paths map to bodies and missing paths get status.
+func serveReleases(bodies map[string]string, status int) (string, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := bodies[r.URL.Path]
+		if !ok {
+			w.WriteHeader(status)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	previousURL, previousClient := officialURL, httpClient
+	officialURL, httpClient = server.URL+"/official", server.Client()
+	return server.URL + "/release", func() {
+		officialURL, httpClient = previousURL, previousClient
+		server.Close()
+	}
+}
+
+func TestCheckRelease(t *testing.T) {
+	tests := []struct {
+		name     string
+		bodies   map[string]string
+		status   int
+		official int64
+		built    int64
+		update   bool
+	}{
+		{
+			name: "new release",
+			bodies: map[string]string{
+				"/official/marlin-stable":               "OPM4.171019.021.P1 1529000000 marlin stable",
+				"/release/marlin-stable-true-timestamp": "1528000000\n",
+			},
+			status:   http.StatusNotFound,
+			official: 1529000000,
+			built:    1528000000,
+			update:   true,
+		},
+		{
+			name: "up to date",
+			bodies: map[string]string{
+				"/official/marlin-stable":               "OPM4.171019.021.P1 1529000000 marlin stable",
+				"/release/marlin-stable-true-timestamp": "1529000000\n",
+			},
+			status:   http.StatusNotFound,
+			official: 1529000000,
+			built:    1529000000,
+		},
+		{
+			name: "not built yet",
+			bodies: map[string]string{
+				"/official/marlin-stable": "OPM4.171019.021.P1 1529000000 marlin stable",
+			},
+			status:   http.StatusNotFound,
+			official: 1529000000,
+			update:   true,
+		},
+		{
+			// s3 denies access to missing objects of a public bucket
+			name: "not built yet forbidden",
+			bodies: map[string]string{
+				"/official/marlin-stable": "OPM4.171019.021.P1 1529000000 marlin stable",
+			},
+			status:   http.StatusForbidden,
+			official: 1529000000,
+			update:   true,
+		},
+	}
+	for _, test := range tests {
+		releaseURL, cleanup := serveReleases(test.bodies, test.status)
+		release, err := CheckRelease(releaseURL, "marlin")
+		cleanup()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if release.Official != test.official || release.Built != test.built {
+			t.Errorf("%s: got official %d built %d, want official %d built %d", test.name,
+				release.Official, release.Built, test.official, test.built)
+		}
+		if release.UpdateAvailable() != test.update {
+			t.Errorf("%s: got update available %v, want %v", test.name, release.UpdateAvailable(), test.update)
+		}
+	}
+}
+
+func TestCheckReleaseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		bodies map[string]string
+	}{
+		{
+			name:   "no official release",
+			bodies: map[string]string{},
+		},
+		{
+			name:   "official metadata without timestamp",
+			bodies: map[string]string{"/official/marlin-stable": "OPM4.171019.021.P1"},
+		},
+		{
+			name:   "invalid official timestamp",
+			bodies: map[string]string{"/official/marlin-stable": "OPM4.171019.021.P1 yesterday"},
+		},
+		{
+			name: "invalid release timestamp",
+			bodies: map[string]string{
+				"/official/marlin-stable":               "OPM4.171019.021.P1 1529000000 marlin stable",
+				"/release/marlin-stable-true-timestamp": "yesterday",
+			},
+		},
+	}
+	for _, test := range tests {
+		releaseURL, cleanup := serveReleases(test.bodies, http.StatusNotFound)
+		_, err := CheckRelease(releaseURL, "marlin")
+		cleanup()
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestUpdateAvailable(t *testing.T) {
+	tests := []struct {
+		release Release
+		want    bool
+	}{
+		{Release{Official: 2, Built: 1}, true},
+		{Release{Official: 2, Built: 2}, false},
+		{Release{Official: 2, Built: 3}, false},
+		{Release{Official: 2}, true},
+	}
+	for _, test := range tests {
+		if got := test.release.UpdateAvailable(); got != test.want {
+			t.Errorf("official %d built %d: got %v, want %v", test.release.Official, test.release.Built, got, test.want)
+		}
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2018, 6, 1, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		window *Window
+		t      time.Time
+		want   bool
+	}{
+		{nil, at(12, 0), true},
+		{&Window{Start: 60, End: 300}, at(0, 59), false},
+		{&Window{Start: 60, End: 300}, at(1, 0), true},
+		{&Window{Start: 60, End: 300}, at(4, 59), true},
+		{&Window{Start: 60, End: 300}, at(5, 0), false},
+		// 22:00 to 04:00 wraps around midnight
+		{&Window{Start: 1320, End: 240}, at(21, 59), false},
+		{&Window{Start: 1320, End: 240}, at(22, 0), true},
+		{&Window{Start: 1320, End: 240}, at(0, 0), true},
+		{&Window{Start: 1320, End: 240}, at(3, 59), true},
+		{&Window{Start: 1320, End: 240}, at(4, 0), false},
+		{&Window{Start: 1320, End: 240}, at(12, 0), false},
+		// the window is in utc regardless of the zone of t
+		{&Window{Start: 60, End: 300}, at(2, 0).In(time.FixedZone("UTC+10", 10*3600)), true},
+	}
+	for _, test := range tests {
+		if got := test.window.InWindow(test.t); got != test.want {
+			t.Errorf("window %+v at %s: got %v, want %v", test.window, test.t, got, test.want)
+		}
+	}
+}
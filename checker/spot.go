@@ -0,0 +1,187 @@
+package checker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+)
+
+// spotAdvisorURL serves the data behind the Spot Instance Advisor: the vCPUs
+// of every instance type and how often spot instances of it were interrupted
+// in each region over the last month.
+const spotAdvisorURL = "https://spot-bid-advisor.s3.amazonaws.com/spot-advisor-data.json"
+
+// interruptionPenalty is how much each step up in the interruption frequency
+// ranges of the advisor (<5%, 5-10%, 10-15%, 15-20%, >20%) raises the score of
+// a candidate. An interrupted build has to start over, so a slightly more
+// expensive but more stable instance is the better deal.
+const interruptionPenalty = 0.25
+
+// maxFleetCandidates is how many of the best ranked candidates a spot fleet
+// request may choose from.
+const maxFleetCandidates = 4
+
+// SpotCandidate is an instance type in an availability zone a build could run
+// on.
+type SpotCandidate struct {
+	InstanceType string
+	Zone         string
+	SubnetID     string
+	// Price is the current spot price in USD per hour
+	Price float64
+	VCPUs int
+	// Interruption is the index of the interruption frequency range of the
+	// advisor, -1 when unknown
+	Interruption      int
+	InterruptionLabel string
+}
+
+// PricePerVCPU is the current spot price per vCPU and hour.
+func (candidate SpotCandidate) PricePerVCPU() float64 {
+	return candidate.Price / float64(candidate.VCPUs)
+}
+
+// Score ranks candidates, lower is better. It is the price per vCPU, raised
+// for instance types that are interrupted more often.
+func (candidate SpotCandidate) Score() float64 {
+	interruption := candidate.Interruption
+	if interruption < 0 {
+		// assume the middle range when the advisor has no data
+		interruption = 2
+	}
+	return candidate.PricePerVCPU() * (1 + interruptionPenalty*float64(interruption))
+}
+
+type spotAdvisorData struct {
+	Ranges []struct {
+		Index int    `json:"index"`
+		Label string `json:"label"`
+	} `json:"ranges"`
+	InstanceTypes map[string]struct {
+		Cores int `json:"cores"`
+	} `json:"instance_types"`
+	SpotAdvisor map[string]map[string]map[string]struct {
+		Interruption int `json:"r"`
+	} `json:"spot_advisor"`
+}
+
+// RankSpotCandidates returns the instance types in the availability zones of
+// subnets (zone to subnet id), or in every zone of the region when subnets is
+// nil, best ranked first. Combinations without a current spot price aren't
+// offered and left out.
+func RankSpotCandidates(ec2Client *ec2.EC2, region string, instanceTypes []string, subnets map[string]string) ([]SpotCandidate, error) {
+	prices := map[string]map[string]float64{}
+	// only the current price of each zone, anything older is superseded
+	err := ec2Client.DescribeSpotPriceHistoryPages(&ec2.DescribeSpotPriceHistoryInput{
+		InstanceTypes:       aws.StringSlice(instanceTypes),
+		ProductDescriptions: aws.StringSlice([]string{"Linux/UNIX"}),
+		StartTime:           aws.Time(time.Now()),
+	}, func(page *ec2.DescribeSpotPriceHistoryOutput, lastPage bool) bool {
+		for _, history := range page.SpotPriceHistory {
+			price, err := strconv.ParseFloat(aws.StringValue(history.SpotPrice), 64)
+			if err != nil {
+				continue
+			}
+			instanceType := aws.StringValue(history.InstanceType)
+			if prices[instanceType] == nil {
+				prices[instanceType] = map[string]float64{}
+			}
+			prices[instanceType][aws.StringValue(history.AvailabilityZone)] = price
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to describe spot price history: %v", err)
+	}
+
+	advisor, err := fetchSpotAdvisor()
+	if err != nil {
+		log.Warnf("Ranking spot instances without interruption history: %v", err)
+		advisor = &spotAdvisorData{}
+	}
+
+	candidates := []SpotCandidate{}
+	for _, instanceType := range instanceTypes {
+		vcpus := advisor.InstanceTypes[instanceType].Cores
+		if vcpus == 0 {
+			vcpus = estimateVCPUs(instanceType)
+		}
+		interruption, label := -1, "unknown"
+		if frequency, ok := advisor.SpotAdvisor[region]["Linux"][instanceType]; ok {
+			interruption = frequency.Interruption
+			for _, r := range advisor.Ranges {
+				if r.Index == interruption {
+					label = r.Label
+				}
+			}
+		}
+		for zone, price := range prices[instanceType] {
+			subnetID := ""
+			if subnets != nil {
+				if subnetID = subnets[zone]; subnetID == "" {
+					continue
+				}
+			}
+			candidates = append(candidates, SpotCandidate{
+				InstanceType:      instanceType,
+				Zone:              zone,
+				SubnetID:          subnetID,
+				Price:             price,
+				VCPUs:             vcpus,
+				Interruption:      interruption,
+				InterruptionLabel: label,
+			})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Score() != candidates[j].Score() {
+			return candidates[i].Score() < candidates[j].Score()
+		}
+		return candidates[i].Zone < candidates[j].Zone
+	})
+	return candidates, nil
+}
+
+func fetchSpotAdvisor() (*spotAdvisorData, error) {
+	body, found, err := fetch(spotAdvisorURL)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("No spot advisor data at %s", spotAdvisorURL)
+	}
+	advisor := &spotAdvisorData{}
+	if err := json.Unmarshal([]byte(body), advisor); err != nil {
+		return nil, fmt.Errorf("Failed to parse spot advisor data: %v", err)
+	}
+	return advisor, nil
+}
+
+// estimateVCPUs guesses the vCPUs of an instance type from its size, which
+// holds for the compute, general purpose and memory optimized families.
+func estimateVCPUs(instanceType string) int {
+	parts := strings.SplitN(instanceType, ".", 2)
+	if len(parts) != 2 {
+		return 1
+	}
+	size := parts[1]
+	switch size {
+	case "medium":
+		return 1
+	case "large":
+		return 2
+	case "xlarge":
+		return 4
+	}
+	if n, err := strconv.Atoi(strings.TrimSuffix(size, "xlarge")); err == nil && n > 0 {
+		return 4 * n
+	}
+	return 1
+}
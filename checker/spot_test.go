@@ -0,0 +1,47 @@
+package checker
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestEstimateVCPUs(t *testing.T) {
+	tests := map[string]int{
+		"t2.medium":   1,
+		"c5.large":    2,
+		"c5.xlarge":   4,
+		"c5.2xlarge":  8,
+		"c5.4xlarge":  16,
+		"c4.8xlarge":  32,
+		"c5.18xlarge": 72,
+		"m5.metal":    1,
+		"invalid":     1,
+	}
+	for instanceType, want := range tests {
+		if got := estimateVCPUs(instanceType); got != want {
+			t.Errorf("%s: got %d vCPUs, want %d", instanceType, got, want)
+		}
+	}
+}
+
+func TestSpotCandidateScore(t *testing.T) {
+	candidates := []SpotCandidate{
+		{InstanceType: "c5.9xlarge", Price: 1.44, VCPUs: 36, Interruption: 3},
+		{InstanceType: "c5.4xlarge", Price: 0.64, VCPUs: 16, Interruption: 0},
+		{InstanceType: "c4.4xlarge", Price: 0.56, VCPUs: 16, Interruption: -1},
+		{InstanceType: "m5.4xlarge", Price: 0.80, VCPUs: 16, Interruption: 0},
+	}
+	if got := candidates[1].PricePerVCPU(); got != 0.04 {
+		t.Errorf("got price per vCPU %f, want 0.04", got)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Score() < candidates[j].Score()
+	})
+	// c4.4xlarge is cheapest per vCPU but unknown interruptions count as the middle range
+	want := []string{"c5.4xlarge", "m5.4xlarge", "c4.4xlarge", "c5.9xlarge"}
+	for i, candidate := range candidates {
+		if candidate.InstanceType != want[i] {
+			t.Errorf("rank %d: got %s, want %s", i, candidate.InstanceType, want[i])
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var costMonths int
+
+var costCmd = &cobra.Command{
+	Use:   "cost",
+	Short: "Report monthly spend of a stack from Cost Explorer, per service and per build",
+	Long: `Report monthly spend of a stack from Cost Explorer, broken down by EC2, EBS, S3 and data transfer.
+The per build cost is the EC2, EBS and data transfer spend of a month divided by the number of builds in that month.
+Costs are attributed using the 'chos:stack' tag, which has to be activated as a cost allocation tag in the
+AWS billing console. Cost Explorer only reports on tags from the time they are activated.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if costMonths < 1 {
+			return errors.New("Must report on at least 1 month")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSCost(stack.StackConfig{
+			Name:       name,
+			Region:     region,
+			S3Endpoint: s3Endpoint,
+		}, costMonths)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	addStackFlags(costCmd)
+	costCmd.Flags().IntVar(&costMonths, "months", 3, "number of months to report on, including the current month.")
+	addS3EndpointFlag(costCmd)
+	RootCmd.AddCommand(costCmd)
+}
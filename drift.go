@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var driftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "Report changes made to a deployed stack outside of copperheados-stack",
+	Long: `Compare a deployed stack with what a deploy with the same flags would create, without changing anything.
+Exits with status 2 when the stack has drifted, so it can be run on a schedule.`,
+	Args: validateDeployFlags,
+	Run: func(cmd *cobra.Command, args []string) {
+		drifted, err := stack.AWSDrift(deployConfig())
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if drifted {
+			os.Exit(2)
+		}
+	},
+}
+
+func init() {
+	addDeployFlags(driftCmd)
+	RootCmd.AddCommand(driftCmd)
+}
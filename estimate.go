@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var buildsPerMonth float64
+var buildDuration time.Duration
+
+var estimateCmd = &cobra.Command{
+	Use:   "estimate",
+	Short: "Estimate the monthly cost of a stack before deploying it",
+	Long: `Estimate the monthly cost of a stack from the AWS Pricing API and the spot price history of the region.
+The estimate covers build instances, their root volume and S3 storage of OTA updates, target files and factory
+images under the configured retention. Months with a Chromium rebuild take considerably longer to build.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(instanceTypes) == 0 {
+			return errors.New("Must specify at least one instance type")
+		}
+		if err := validateVolume(); err != nil {
+			return err
+		}
+		if buildsPerMonth <= 0 || buildDuration <= 0 {
+			return errors.New("Must specify a positive number of builds per month and build duration")
+		}
+		if releaseRetention < 1 {
+			return errors.New("Must retain releases for at least 1 day")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSEstimate(stack.StackConfig{
+			Region:           region,
+			InstanceTypes:    instanceTypes,
+			VolumeSize:       volumeSize,
+			VolumeType:       volumeType,
+			ReleaseRetention: releaseRetention,
+		}, stack.EstimateUsage{
+			BuildsPerMonth: buildsPerMonth,
+			BuildDuration:  buildDuration,
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	estimateCmd.Flags().StringVarP(&region, "region", "r", "", "aws region to estimate costs for (e.g. us-west-2)")
+	estimateCmd.MarkFlagRequired("region")
+	estimateCmd.Flags().StringSliceVar(&instanceTypes, "instance-types", []string{"c5.4xlarge", "c4.4xlarge"}, "comma separated list of ec2 instance types to build on.")
+	estimateCmd.Flags().IntVar(&volumeSize, "volume-size", 200, "size in GB of the root volume for build ec2 instances.")
+	estimateCmd.Flags().StringVar(&volumeType, "volume-type", "gp2", "ebs volume type of the root volume for build ec2 instances (gp2|gp3|standard).")
+	estimateCmd.Flags().IntVar(&releaseRetention, "release-retention-days", 30, "number of days releases are kept in the release bucket.")
+	estimateCmd.Flags().Float64Var(&buildsPerMonth, "builds-per-month", 4, "expected number of builds per month.")
+	estimateCmd.Flags().DurationVar(&buildDuration, "build-duration", 4*time.Hour, "expected average duration of a build.")
+	RootCmd.AddCommand(estimateCmd)
+}
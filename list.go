@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var listAllRegions bool
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the stacks in the AWS account with their devices, version and last build",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if (region == "") == !listAllRegions {
+			return errors.New("Must specify either --region or --all-regions")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSList(region)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	listCmd.Flags().StringVarP(&region, "region", "r", "", "aws region to list the stacks of (e.g. us-west-2)")
+	listCmd.Flags().BoolVar(&listAllRegions, "all-regions", false, "list the stacks of all regions.")
+	RootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var logsBuildID string
+var logsFollow bool
+
+var logsCmd = &cobra.Command{
+	Use:   "logs",
+	Short: "Print the log of the current or a previous build",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSLogs(stack.StackConfig{
+			Name:       name,
+			Region:     region,
+			S3Endpoint: s3Endpoint,
+		}, device, logsBuildID, logsFollow)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	addStackFlags(logsCmd)
+	logsCmd.Flags().StringVarP(&device, "device", "d", "", "device of the build.")
+	logsCmd.MarkFlagRequired("device")
+	logsCmd.Flags().StringVar(&logsBuildID, "build", "", "id of the build to print the log of. defaults to the current build.")
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "keep printing new log lines until the build finishes.")
+	addS3EndpointFlag(logsCmd)
+	RootCmd.AddCommand(logsCmd)
+}
@@ -2,65 +2,300 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/dan-v/copperheados-stack/checker"
 	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var version string
-var name, region, device, ami, sshKey, spotPrice string
+var name, region, device, ami, sshKey, sshCIDR, spotPrice, otaDomain, otaZone string
+var fallbackPolicy, maxSpotPrice string
+var schedule, buildWindow string
+var parsedBuildWindow *stack.BuildWindow
+var fallbackAfter time.Duration
 var remove, preventShutdown bool
+var instanceTypes, notifyEmails, notifySMS, replicaRegions []string
+var volumeSize, releaseRetention, logRetention, noBuildAlarmDays int
+var volumeType, s3Endpoint, engine, checkerBinary string
+var maxBuildDuration time.Duration
+
+// Environment variables holding the credentials build instances and the build
+// checker access --s3-endpoint with
+const (
+	s3EndpointKeyIDEnv  = "S3_ENDPOINT_ACCESS_KEY_ID"
+	s3EndpointSecretEnv = "S3_ENDPOINT_SECRET_ACCESS_KEY"
+)
 
 var RootCmd = &cobra.Command{
 	Use:   "copperheados-stack",
 	Short: "Setup AWS infrastructure to build CopperheadOS with OTA updates",
 	Args: func(cmd *cobra.Command, args []string) error {
-		if device != "marlin" && device != "sailfish" && device != "taimen" && device != "walleye" {
-			return errors.New("Must specify either marlin|sailfish|taimen|walleye for device type")
+		if err := validateDeployFlags(cmd, args); err != nil {
+			return err
+		}
+		if !remove && s3Endpoint != "" && (os.Getenv(s3EndpointKeyIDEnv) == "" || os.Getenv(s3EndpointSecretEnv) == "") {
+			return fmt.Errorf("Must set %s and %s to credentials of --s3-endpoint for build instances and the build checker, it doesn't accept the credentials of their AWS roles", s3EndpointKeyIDEnv, s3EndpointSecretEnv)
 		}
 		return nil
 	},
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateS3Endpoint()
+	},
 	Version: version,
 	Run: func(cmd *cobra.Command, args []string) {
 		if !remove {
-			stack.AWSApply(
-				stack.StackConfig{
-					Name:            name,
-					Region:          region,
-					Device:          device,
-					AMI:             ami,
-					SSHKey:          sshKey,
-					SpotPrice:       spotPrice,
-					PreventShutdown: preventShutdown,
-				},
-			)
+			stack.AWSApply(deployConfig())
 		} else {
-			stack.AWSDestroy(
-				stack.StackConfig{
-					Name:   name,
-					Region: region,
-				},
-			)
+			// resources of every deploy flag have to be in the config to be destroyed
+			stack.AWSDestroy(deployConfig())
 		}
 	},
 }
 
 func init() {
-	RootCmd.Flags().StringVarP(&name, "name", "n", "", "name for stack. note: this must be a valid/unique S3 bucket name.")
-	RootCmd.MarkFlagRequired("name")
-	RootCmd.Flags().StringVarP(&region, "region", "r", "", "aws region for deployment (e.g. us-west-2)")
-	RootCmd.MarkFlagRequired("region")
-	RootCmd.Flags().StringVarP(&device, "device", "d", "", "device you want to build for: 'marlin' (Pixel XL) or 'sailfish' (Pixel)")
-	RootCmd.MarkFlagRequired("device")
-	RootCmd.Flags().StringVar(&sshKey, "ssh-key", "", "aws ssh key to add to ec2 spot instances. this is optional but is useful for debugging build issues on the instance.")
-	RootCmd.Flags().StringVar(&spotPrice, "spot-price", ".80", "spot price for build ec2 instances. if this value is too low you may not obtain an instance or it may terminate during a build.")
-	RootCmd.Flags().StringVar(&ami, "ami", "", "ami id to use for build environment. this is optional as correct ubuntu ami for region will be chosen by default.")
+	addDeployFlags(RootCmd)
 	RootCmd.Flags().BoolVar(&remove, "remove", false, "cleanup/destroy all deployed aws resources.")
-	RootCmd.Flags().BoolVar(&preventShutdown, "prevent-shutdown", false, "for debugging purposes only - will prevent ec2 instance from shutting down after build.")
+}
+
+// addDeployFlags adds the flags configuring a stack to a subcommand that
+// deploys or renders it.
+func addDeployFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&name, "name", "n", "", "name for stack. note: this must be a valid/unique S3 bucket name.")
+	cmd.MarkFlagRequired("name")
+	cmd.Flags().StringVarP(&region, "region", "r", "", "aws region for deployment (e.g. us-west-2)")
+	cmd.MarkFlagRequired("region")
+	cmd.Flags().StringVarP(&device, "device", "d", "", "device you want to build for: 'marlin' (Pixel XL) or 'sailfish' (Pixel)")
+	cmd.MarkFlagRequired("device")
+	cmd.Flags().StringVar(&sshKey, "ssh-key", "", "aws ssh key to add to ec2 spot instances. this is optional but is useful for debugging build issues on the instance.")
+	cmd.Flags().StringVar(&sshCIDR, "ssh-cidr", "", "cidr block allowed to ssh into ec2 spot instances (e.g. 203.0.113.10/32). required when --ssh-key is set.")
+	cmd.Flags().StringVar(&spotPrice, "spot-price", ".80", "spot price for build ec2 instances. if this value is too low you may not obtain an instance or it may terminate during a build.")
+	cmd.Flags().StringVar(&schedule, "schedule", "rate(1 day)", "how often to check for new releases. either a rate(...) or cron(...) cloudwatch schedule expression, or the 6 cron fields (e.g. '0 */6 ? * TUE *'). times are UTC.")
+	cmd.Flags().StringVar(&buildWindow, "build-window", "", "only start builds between these times of day (UTC), e.g. '22:00-06:00'. releases found outside of the window are built once it opens.")
+	cmd.Flags().StringVar(&fallbackPolicy, "fallback", "none", "what to do when a spot request is not fulfilled within --fallback-after: 'none' (just notify), 'on-demand' (build on an on-demand instance) or 'raise-price' (retry with a higher spot price up to --max-spot-price).")
+	cmd.Flags().DurationVar(&fallbackAfter, "fallback-after", 2*time.Hour, "how long to wait for a spot request to be fulfilled before applying the fallback policy.")
+	cmd.Flags().StringVar(&maxSpotPrice, "max-spot-price", "", "highest spot price the 'raise-price' fallback policy is allowed to bid.")
+	cmd.Flags().StringSliceVar(&instanceTypes, "instance-types", []string{"c5.4xlarge", "c4.4xlarge"}, "comma separated list of ec2 instance types to build on. spot requests rank them by price per vCPU and interruptions, the first type is preferred whenever a single type has to be chosen.")
+	cmd.Flags().IntVar(&volumeSize, "volume-size", 200, "size in GB of the root volume for build ec2 instances.")
+	cmd.Flags().StringVar(&volumeType, "volume-type", "gp2", "ebs volume type of the root volume for build ec2 instances (gp2|gp3|standard).")
+	cmd.Flags().DurationVar(&maxBuildDuration, "max-build-duration", 12*time.Hour, "maximum time a build ec2 instance is allowed to run before it is terminated.")
+	cmd.Flags().IntVar(&releaseRetention, "release-retention-days", 30, "number of days to keep target files, incremental updates and old OTA updates in the release bucket.")
+	cmd.Flags().IntVar(&logRetention, "log-retention-days", 30, "number of days to keep build logs streamed to cloudwatch logs. archived logs in the logs bucket are kept regardless.")
+	cmd.Flags().IntVar(&noBuildAlarmDays, "no-build-alarm-days", 7, "notify when there has been no successful build for this many days (at most 7). 0 disables the alarm.")
+	cmd.Flags().StringVar(&ami, "ami", "", "ami id to use for build environment. this is optional as correct ubuntu ami for region will be chosen by default.")
+	cmd.Flags().StringVar(&otaDomain, "ota-domain", "", "custom domain to serve OTA updates from (e.g. updates.example.org). this is optional and requires a matching Route53 hosted zone in the account.")
+	cmd.Flags().StringVar(&otaZone, "ota-zone", "", "Route53 hosted zone of --ota-domain (e.g. example.org). this is optional as the hosted zone of the account that is the longest match of the domain is used by default, except for render.")
+	cmd.Flags().StringSliceVar(&replicaRegions, "replica-region", []string{}, "aws region to replicate the release bucket to. can be repeated or comma separated. cloudfront serves OTA updates from the first replica when the release bucket is unavailable. requires --ota-domain.")
+	addS3EndpointFlag(cmd)
+	cmd.Flags().StringArrayVar(&notifyEmails, "notify-email", []string{}, "email address to send build notifications to. can be repeated. every address receives a confirmation email that has to be accepted first.")
+	cmd.Flags().StringArrayVar(&notifySMS, "notify-sms", []string{}, "phone number in E.164 format (e.g. +15555550100) to send build notifications to by sms. can be repeated.")
+	cmd.Flags().StringVar(&engine, "engine", stack.EngineTerraform, "how to provision aws resources: 'terraform' (downloads and runs terraform) or 'native' (uses the aws api directly, much faster for updates). the first native run takes over the terraform state of an existing stack.")
+	cmd.Flags().StringVar(&checkerBinary, "checker-binary", "", "linux amd64 copperheados-stack binary of the same version to run the build checker lambda function with. only needed when not running copperheados-stack on linux amd64.")
+	cmd.Flags().BoolVar(&preventShutdown, "prevent-shutdown", false, "for debugging purposes only - will prevent ec2 instance from shutting down after build.")
+}
+
+func validateDeployFlags(cmd *cobra.Command, args []string) error {
+	if err := validateDevice(); err != nil {
+		return err
+	}
+	if len(instanceTypes) == 0 {
+		return errors.New("Must specify at least one instance type")
+	}
+	if err := validateVolume(); err != nil {
+		return err
+	}
+	if releaseRetention < 1 {
+		return errors.New("Must retain releases for at least 1 day")
+	}
+	if !stack.ValidLogRetention(logRetention) {
+		return fmt.Errorf("Log retention of %d days is not supported by CloudWatch Logs, use one of %v", logRetention, stack.LogRetentionDays)
+	}
+	if noBuildAlarmDays < 0 || noBuildAlarmDays > 7 {
+		return errors.New("Must specify between 0 and 7 days for --no-build-alarm-days, cloudwatch alarms can't look back further")
+	}
+	if engine != stack.EngineTerraform && engine != stack.EngineNative {
+		return errors.New("Must specify either terraform|native for engine")
+	}
+	if engine == stack.EngineNative && otaDomain != "" {
+		return errors.New("The native engine doesn't support --ota-domain yet, use --engine terraform")
+	}
+	if otaZone != "" {
+		otaZone = strings.TrimSuffix(otaZone, ".")
+		if otaDomain == "" {
+			return errors.New("Must specify --ota-domain when using --ota-zone")
+		}
+		if otaDomain != otaZone && !strings.HasSuffix(otaDomain, "."+otaZone) {
+			return fmt.Errorf("--ota-domain %s is not in --ota-zone %s", otaDomain, otaZone)
+		}
+	}
+	if len(replicaRegions) > 0 && otaDomain == "" {
+		return errors.New("Must specify --ota-domain when using --replica-region, devices need an endpoint that doesn't depend on the region of the release bucket")
+	}
+	for i, replicaRegion := range replicaRegions {
+		if replicaRegion == region {
+			return errors.New("Must specify a --replica-region other than --region")
+		}
+		for _, other := range replicaRegions[:i] {
+			if replicaRegion == other {
+				return fmt.Errorf("Must specify --replica-region %s only once", replicaRegion)
+			}
+		}
+	}
+	if maxBuildDuration < time.Hour {
+		return errors.New("Must allow a maximum build duration of at least 1h")
+	}
+	if fallbackPolicy != "none" && fallbackPolicy != "on-demand" && fallbackPolicy != "raise-price" {
+		return errors.New("Must specify either none|on-demand|raise-price for fallback policy")
+	}
+	if fallbackPolicy == "raise-price" {
+		ceiling, err := strconv.ParseFloat(maxSpotPrice, 64)
+		if err != nil {
+			return errors.New("Must specify a valid --max-spot-price when using raise-price fallback policy")
+		}
+		price, err := strconv.ParseFloat(spotPrice, 64)
+		if err != nil || price >= ceiling {
+			return errors.New("Must specify a --max-spot-price above --spot-price when using raise-price fallback policy")
+		}
+	}
+	normalizedSchedule, err := stack.NormalizeSchedule(schedule)
+	if err != nil {
+		return err
+	}
+	schedule = normalizedSchedule
+	if buildWindow != "" {
+		parsedBuildWindow, err = stack.ParseBuildWindow(buildWindow)
+		if err != nil {
+			return err
+		}
+	}
+	for _, email := range notifyEmails {
+		if _, err := mail.ParseAddress(email); err != nil {
+			return fmt.Errorf("Invalid --notify-email %s: %v", email, err)
+		}
+	}
+	for _, number := range notifySMS {
+		if !stack.ValidSMSNumber(number) {
+			return fmt.Errorf("Invalid --notify-sms %s: must be in E.164 format (e.g. +15555550100)", number)
+		}
+	}
+	if sshKey != "" {
+		if sshCIDR == "" {
+			return errors.New("Must specify --ssh-cidr to allow SSH access when using --ssh-key")
+		}
+		if _, _, err := net.ParseCIDR(sshCIDR); err != nil {
+			return fmt.Errorf("Invalid --ssh-cidr %s: %v", sshCIDR, err)
+		}
+	}
+	return nil
+}
+
+// deployConfig is the config of the stack described by the deploy flags.
+func deployConfig() stack.StackConfig {
+	return stack.StackConfig{
+		Name:             name,
+		Region:           region,
+		Device:           device,
+		AMI:              ami,
+		SSHKey:           sshKey,
+		SSHCIDR:          sshCIDR,
+		SpotPrice:        spotPrice,
+		PreventShutdown:  preventShutdown,
+		OTADomain:        otaDomain,
+		OTAZone:          otaZone,
+		ReplicaRegions:   replicaRegions,
+		InstanceTypes:    instanceTypes,
+		VolumeSize:       volumeSize,
+		VolumeType:       volumeType,
+		MaxBuildDuration: maxBuildDuration,
+		FallbackPolicy:   fallbackPolicy,
+		FallbackAfter:    fallbackAfter,
+		MaxSpotPrice:     maxSpotPrice,
+		Schedule:         schedule,
+		BuildWindow:      parsedBuildWindow,
+		Version:          stackVersion(),
+		ReleaseRetention: releaseRetention,
+		LogRetention:     logRetention,
+		NotifyEmails:     notifyEmails,
+		NotifySMS:        notifySMS,
+		NoBuildAlarmDays: noBuildAlarmDays,
+		S3Endpoint:       s3Endpoint,
+		S3EndpointKeyID:  os.Getenv(s3EndpointKeyIDEnv),
+		S3EndpointSecret: os.Getenv(s3EndpointSecretEnv),
+		Engine:           engine,
+		CheckerBinary:    checkerBinary,
+	}
+}
+
+// addStackFlags adds the flags identifying an existing stack to a subcommand.
+func addStackFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&name, "name", "n", "", "name of the stack.")
+	cmd.MarkFlagRequired("name")
+	cmd.Flags().StringVarP(&region, "region", "r", "", "aws region the stack is deployed in (e.g. us-west-2)")
+	cmd.MarkFlagRequired("region")
+}
+
+// addS3EndpointFlag adds the flag for stacks keeping their buckets on an S3
+// compatible service to a subcommand that accesses them.
+func addS3EndpointFlag(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&s3Endpoint, "s3-endpoint", "", "url of an s3 compatible service (e.g. minio or ceph) to keep the stack state and buckets on instead of aws s3, accessed with path style addressing. it has to be reachable from build instances and devices.")
+}
+
+func validateS3Endpoint() error {
+	if s3Endpoint == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(s3Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("Invalid --s3-endpoint %s: must be an http or https url", s3Endpoint)
+	}
+	if otaDomain != "" {
+		return errors.New("Can't serve OTA updates from --ota-domain when using --s3-endpoint, cloudfront needs the release bucket on aws s3")
+	}
+	s3Endpoint = strings.TrimSuffix(s3Endpoint, "/")
+	return nil
+}
+
+func validateVolume() error {
+	if volumeType != "gp2" && volumeType != "gp3" && volumeType != "standard" {
+		return errors.New("Must specify either gp2|gp3|standard for volume type")
+	}
+	if volumeSize <= 0 {
+		return errors.New("Must specify a positive volume size")
+	}
+	return nil
+}
+
+func validateDevice() error {
+	if device != "marlin" && device != "sailfish" && device != "taimen" && device != "walleye" {
+		return errors.New("Must specify either marlin|sailfish|taimen|walleye for device type")
+	}
+	return nil
+}
+
+func stackVersion() string {
+	if version == "" {
+		return "dev"
+	}
+	return version
 }
 
 func main() {
+	// the build checker lambda function runs this binary as its runtime
+	if checker.InLambda() {
+		if err := checker.ServeLambda(); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 	if err := RootCmd.Execute(); err != nil {
 		os.Exit(-1)
 	}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var webhookID, webhookType, webhookURL string
+
+var notifyCmd = &cobra.Command{
+	Use:   "notify",
+	Short: "Manage build notification webhooks and subscriptions",
+}
+
+var notifyAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a webhook (json, slack or matrix) to post build notifications to",
+	Args: func(cmd *cobra.Command, args []string) error {
+		validType := false
+		for _, t := range stack.WebhookTypes {
+			if webhookType == t {
+				validType = true
+			}
+		}
+		if !validType {
+			return fmt.Errorf("Must specify one of %v for webhook type", stack.WebhookTypes)
+		}
+		if err := validateWebhookID(); err != nil {
+			return err
+		}
+		if u, err := url.Parse(webhookURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("Must specify an https:// webhook url")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSNotifyAdd(stack.StackConfig{
+			Name:   name,
+			Region: region,
+		}, webhookID, stack.Webhook{
+			Type: webhookType,
+			URL:  webhookURL,
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+// webhookIDPattern matches ids that make a single parameter level, the
+// notifier lambda doesn't read nested parameters
+var webhookIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func validateWebhookID() error {
+	if !webhookIDPattern.MatchString(webhookID) {
+		return fmt.Errorf("Invalid webhook id %q: may only contain letters, digits, '_', '.' and '-'", webhookID)
+	}
+	return nil
+}
+
+var notifyRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Remove a webhook",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSNotifyRemove(stack.StackConfig{
+			Name:   name,
+			Region: region,
+		}, webhookID)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+var notifyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List email, sms and other subscriptions to build notifications and whether they are confirmed",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSNotifyList(stack.StackConfig{
+			Name:   name,
+			Region: region,
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+var notifyTestCmd = &cobra.Command{
+	Use:   "test",
+	Short: "Post a test notification to all webhooks, or only to the one given with --id",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSNotifyTest(stack.StackConfig{
+			Name:   name,
+			Region: region,
+		}, webhookID)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	addStackFlags(notifyAddCmd)
+	notifyAddCmd.Flags().StringVar(&webhookID, "id", "", "name of the webhook, used to remove or test it.")
+	notifyAddCmd.MarkFlagRequired("id")
+	notifyAddCmd.Flags().StringVar(&webhookType, "type", "json", "payload format of the webhook: 'json' (build details), 'slack' (slack compatible incoming webhook) or 'matrix' (room send endpoint of the client-server api).")
+	notifyAddCmd.Flags().StringVar(&webhookURL, "url", "", "url to post notifications to.")
+	notifyAddCmd.MarkFlagRequired("url")
+
+	addStackFlags(notifyRemoveCmd)
+	notifyRemoveCmd.Flags().StringVar(&webhookID, "id", "", "name of the webhook to remove.")
+	notifyRemoveCmd.MarkFlagRequired("id")
+
+	addStackFlags(notifyListCmd)
+
+	addStackFlags(notifyTestCmd)
+	notifyTestCmd.Flags().StringVar(&webhookID, "id", "", "name of the webhook to test. defaults to all webhooks.")
+
+	notifyCmd.AddCommand(notifyAddCmd, notifyRemoveCmd, notifyListCmd, notifyTestCmd)
+	RootCmd.AddCommand(notifyCmd)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var publishCmd = &cobra.Command{
+	Use:   "publish",
+	Short: "Publish a release built with build-local to the release bucket of a stack",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSPublish(stack.StackConfig{
+			Name:       name,
+			Region:     region,
+			OTADomain:  otaDomain,
+			S3Endpoint: s3Endpoint,
+		}, localDir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	addStackFlags(publishCmd)
+	publishCmd.Flags().StringVar(&localDir, "dir", "copperheados-build", "directory of the local build.")
+	publishCmd.Flags().StringVar(&otaDomain, "ota-domain", "", "custom domain the stack serves OTA updates from, if any.")
+	addS3EndpointFlag(publishCmd)
+	RootCmd.AddCommand(publishCmd)
+}
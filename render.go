@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var renderDir string
+
+var renderCmd = &cobra.Command{
+	Use:   "render",
+	Short: "Write the generated terraform config, build script and lambda functions to a directory for review",
+	Long: `Write everything a deploy with the same flags would be made from to --out without touching AWS: the terraform
+config (main.tf), the build script, the lambda functions and their zips, and a summary of the stack config (config.json).
+The output is deterministic, so it can be committed to git and diffed between versions of copperheados-stack.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := validateDeployFlags(cmd, args); err != nil {
+			return err
+		}
+		if otaDomain != "" && otaZone == "" {
+			return errors.New("Must specify --ota-zone when rendering with --ota-domain, looking up the hosted zone needs AWS")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.Render(deployConfig(), renderDir)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	addDeployFlags(renderCmd)
+	renderCmd.Flags().StringVarP(&renderDir, "out", "o", "", "directory to write the rendered files to.")
+	renderCmd.MarkFlagRequired("out")
+	RootCmd.AddCommand(renderCmd)
+}
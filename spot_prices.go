@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var spotPricesCmd = &cobra.Command{
+	Use:   "spot-prices",
+	Short: "Show the current spot prices builds would choose from and suggest a --spot-price",
+	Long: `Show the current spot price of each instance type in every availability zone of the region, ranked the
+way the build checker ranks them: by price per vCPU, raised for instance types that are interrupted more often.
+The suggested --spot-price leaves some headroom over the best candidates, so a price increase during a build
+doesn't interrupt it.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(instanceTypes) == 0 {
+			return errors.New("Must specify at least one instance type")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSSpotPrices(region, instanceTypes)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	spotPricesCmd.Flags().StringVarP(&region, "region", "r", "", "aws region to show spot prices for (e.g. us-west-2)")
+	spotPricesCmd.MarkFlagRequired("region")
+	spotPricesCmd.Flags().StringSliceVar(&instanceTypes, "instance-types", []string{"c5.4xlarge", "c4.4xlarge"}, "comma separated list of ec2 instance types to build on.")
+	RootCmd.AddCommand(spotPricesCmd)
+}
@@ -3,10 +3,13 @@ package stack
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/s3"
 	log "github.com/sirupsen/logrus"
 )
@@ -16,6 +19,16 @@ const (
 	awsErrCodeNotFound     = "NotFound"
 )
 
+const terraformStateKey = "terraform.state"
+
+// Tags applied to every resource of a stack, including build instances and
+// their volumes, so resources and spend can be attributed to a stack.
+const (
+	StackTagKey   = "chos:stack"
+	DeviceTagKey  = "chos:device"
+	VersionTagKey = "chos:version"
+)
+
 // ubuntu 16.04 AMI
 var amiMap = map[string]string{
 	"ap-northeast-1": "ami-bec974d8",
@@ -36,17 +49,66 @@ var amiMap = map[string]string{
 }
 
 type StackConfig struct {
-	Name            string
-	Region          string
-	Device          string
-	AMI             string
-	SpotPrice       string
-	SSHKey          string
-	PreventShutdown bool
+	Name             string
+	Region           string
+	Device           string
+	AMI              string
+	SpotPrice        string
+	SSHKey           string
+	SSHCIDR          string
+	PreventShutdown  bool
+	OTADomain        string
+	OTAZone          string
+	ReplicaRegions   []string
+	InstanceTypes    []string
+	VolumeSize       int
+	VolumeType       string
+	MaxBuildDuration time.Duration
+	FallbackPolicy   string
+	FallbackAfter    time.Duration
+	MaxSpotPrice     string
+	Schedule         string
+	BuildWindow      *BuildWindow
+	Version          string
+	ReleaseRetention int
+	LogRetention     int
+	NotifyEmails     []string
+	NotifySMS        []string
+	NoBuildAlarmDays int
+	LocalBuildDir    string
+	S3Endpoint       string
+	S3EndpointKeyID  string
+	S3EndpointSecret string
+	Engine           string
+	CheckerBinary    string
+}
+
+// ReleaseURL is the base URL devices and the build checker use to fetch OTA
+// updates and release metadata. It is baked into every build, so a custom OTA
+// domain should be preferred as it allows the backing bucket to move.
+func (config StackConfig) ReleaseURL() string {
+	if config.OTADomain != "" {
+		return "https://" + config.OTADomain
+	}
+	if config.S3Endpoint != "" {
+		return fmt.Sprintf("%s/%s-release", config.S3Endpoint, config.Name)
+	}
+	return fmt.Sprintf("https://%s-release.s3.amazonaws.com", config.Name)
+}
+
+// s3Config is the client config for the S3 buckets of a stack, which are on a
+// custom S3 compatible endpoint with path style addressing when one is set.
+func s3Config(config StackConfig) *aws.Config {
+	s3Config := &aws.Config{Region: &config.Region}
+	if config.S3Endpoint != "" {
+		s3Config.Endpoint = aws.String(config.S3Endpoint)
+		s3Config.S3ForcePathStyle = aws.Bool(true)
+	}
+	return s3Config
 }
 
 func AWSApply(config StackConfig) error {
-	err := checkAWSCreds(config.Region)
+	err := checkAWSCreds(config)
 	if err != nil {
 		return err
 	}
@@ -59,48 +121,160 @@ func AWSApply(config StackConfig) error {
 		config.AMI = ami
 	}
 
+	err = validateInstanceTypes(config)
+	if err != nil {
+		return err
+	}
+
+	config.OTAZone, err = otaZone(config)
+	if err != nil {
+		return err
+	}
+
 	err = s3BucketSetup(config)
 	if err != nil {
 		return err
 	}
 
-	terraformClient, err := generateConfigAndGetClient(config)
-	defer terraformClient.Cleanup()
+	meta, err := loadStackMeta(config)
+	if err != nil {
+		return err
+	}
+	err = checkStackVersion(config, meta)
+	if err != nil {
+		return err
+	}
+
+	err = lockTableSetup(config)
+	if err != nil {
+		return err
+	}
+
+	if config.S3Endpoint != "" {
+		err = storeS3EndpointCredentials(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	provisioner, err := newProvisioner(config)
+	if err != nil {
+		return err
+	}
+	defer provisioner.Cleanup()
 
 	log.Info("Creating AWS resources")
-	err = terraformClient.Apply()
+	err = provisioner.Apply()
 	if err != nil {
 		log.Fatalln("Failed to create AWS resources:", err)
 	}
 	log.Info("Successfully deployed AWS resources")
+
+	err = upgradeStack(config, meta)
+	if err != nil {
+		return err
+	}
+
+	err = subscribeEmails(config)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
 func AWSDestroy(config StackConfig) error {
-	err := checkAWSCreds(config.Region)
+	err := checkAWSCreds(config)
 	if err != nil {
 		return err
 	}
 
-	terraformClient, err := generateConfigAndGetClient(config)
-	defer terraformClient.Cleanup()
+	// the build checker is removed, so any binary will do
+	if config.CheckerBinary == "" {
+		config.CheckerBinary, err = os.Executable()
+		if err != nil {
+			return err
+		}
+	}
+
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	dynamoClient := dynamodb.New(sess, &aws.Config{Region: &config.Region})
+	exists, err := lockTableExists(dynamoClient, lockTableName(config.Name))
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// stacks deployed before their state was locked have state but no
+		// lock table, which the terraform backend needs
+		deployed, err := stateExists(config)
+		if err != nil {
+			return err
+		}
+		if !deployed {
+			return fmt.Errorf("No state of stack %s found in bucket %s, %s is not a deployed stack", config.Name, config.Name, config.Name)
+		}
+		err = lockTableSetup(config)
+		if err != nil {
+			return err
+		}
+	}
+
+	config.OTAZone, err = otaZone(config)
+	if err != nil {
+		return err
+	}
+
+	provisioner, err := newProvisioner(config)
+	if err != nil {
+		return err
+	}
+	defer provisioner.Cleanup()
 
 	log.Info("Destroying AWS resources")
-	err = terraformClient.Destroy()
+	err = provisioner.Destroy()
 	if err != nil {
 		log.Fatalln("Failed to destroy AWS resources:", err)
 	}
 	log.Info("Successfully removed AWS resources")
+	err = deleteStackMeta(config)
+	if err != nil {
+		return err
+	}
+	err = deleteWebhooks(config)
+	if err != nil {
+		return err
+	}
+	err = deleteS3EndpointCredentials(config)
+	if err != nil {
+		return err
+	}
+
+	// the table also holds the build lock, nothing is left to lock
+	log.Infof("Deleting DynamoDB state lock table %s", lockTableName(config.Name))
+	_, err = dynamoClient.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(lockTableName(config.Name))})
+	if err != nil {
+		return fmt.Errorf("Failed to delete DynamoDB table %s: %v", lockTableName(config.Name), err)
+	}
 	return nil
 }
 
-func checkAWSCreds(region string) error {
-	log.Info("Checking AWS credentials")
+func awsSession() (*session.Session, error) {
 	sess, err := session.NewSession(aws.NewConfig().WithCredentialsChainVerboseErrors(true))
 	if err != nil {
-		return fmt.Errorf("Failed to create new AWS session: %v", err)
+		return nil, fmt.Errorf("Failed to create new AWS session: %v", err)
+	}
+	return sess, nil
+}
+
+func checkAWSCreds(config StackConfig) error {
+	log.Info("Checking AWS credentials")
+	sess, err := awsSession()
+	if err != nil {
+		return err
 	}
-	s3Client := s3.New(sess, &aws.Config{Region: &region})
+	s3Client := s3.New(sess, s3Config(config))
 	_, err = s3Client.ListBuckets(&s3.ListBucketsInput{})
 	if err != nil {
 		return fmt.Errorf("Unable to list S3 buckets - make sure you have valid admin AWS credentials")
@@ -109,11 +283,11 @@ func checkAWSCreds(region string) error {
 }
 
 func s3BucketSetup(config StackConfig) error {
-	sess, err := session.NewSession(aws.NewConfig().WithCredentialsChainVerboseErrors(true))
+	sess, err := awsSession()
 	if err != nil {
-		return fmt.Errorf("Failed to create new AWS session: %v", err)
+		return err
 	}
-	s3Client := s3.New(sess, &aws.Config{Region: &config.Region})
+	s3Client := s3.New(sess, s3Config(config))
 
 	log.Infof("Creating S3 bucket %s", config.Name)
 	_, err = s3Client.HeadBucket(&s3.HeadBucketInput{Bucket: &config.Name})
@@ -139,25 +313,112 @@ func s3BucketSetup(config StackConfig) error {
 			return fmt.Errorf("Failed to create bucket %s - note that this bucket name must be globally unique. %v", config.Name, err)
 		}
 	}
+
+	// versioning allows restoring previous terraform state, see AWSStateRestore
+	_, err = s3Client.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: &config.Name,
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(s3.BucketVersioningStatusEnabled),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to enable versioning on bucket %s: %v", config.Name, err)
+	}
+
+	_, err = s3Client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: &config.Name,
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{
+				{
+					ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+						SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to enable default encryption on bucket %s: %v", config.Name, err)
+	}
 	return nil
 }
 
-func getAMI(region string) (string, error) {
-	if _, ok := amiMap[region]; !ok {
-		return "", fmt.Errorf("Unknown region %s. Need to manually specify AMI.", region)
+// lockTableName is the DynamoDB table terraform uses to lock the stack state.
+func lockTableName(name string) string {
+	return name + "-terraform-lock"
+}
+
+func lockTableExists(dynamoClient *dynamodb.DynamoDB, tableName string) (bool, error) {
+	_, err := dynamoClient.DescribeTable(&dynamodb.DescribeTableInput{TableName: &tableName})
+	if err == nil {
+		return true, nil
 	}
-	return amiMap[region], nil
+	if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		return false, fmt.Errorf("Unknown DynamoDB error: %v", err)
+	}
+	return false, nil
+}
+
+func lockTableSetup(config StackConfig) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	dynamoClient := dynamodb.New(sess, &aws.Config{Region: &config.Region})
+
+	tableName := lockTableName(config.Name)
+	exists, err := lockTableExists(dynamoClient, tableName)
+	if err != nil || exists {
+		return err
+	}
+
+	log.Infof("Creating DynamoDB state lock table %s", tableName)
+	_, err = dynamoClient.CreateTable(&dynamodb.CreateTableInput{
+		TableName: &tableName,
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("LockID"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("LockID"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create DynamoDB table %s: %v", tableName, err)
+	}
+	return dynamoClient.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: &tableName})
 }
 
-func generateConfigAndGetClient(config StackConfig) (*TerraformClient, error) {
-	terraformConf, err := generateTerraformConfig(config)
+// validateInstanceTypes makes sure every configured build instance type is
+// offered as a spot instance in the region. Spot price history is used as
+// there is no direct way to list instance types available in a region.
+func validateInstanceTypes(config StackConfig) error {
+	log.Infof("Checking instance types %v are available in %s", config.InstanceTypes, config.Region)
+	sess, err := awsSession()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to generate config: %v", err)
+		return err
 	}
+	ec2Client := ec2.New(sess, &aws.Config{Region: &config.Region})
 
-	terraformClient, err := NewTerraformClient(terraformConf, os.Stdout, os.Stdin)
+	prices, err := averageSpotPrices(ec2Client, config.InstanceTypes, 0)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create client: %v", err)
+		return err
+	}
+
+	for _, instanceType := range config.InstanceTypes {
+		if _, ok := prices[instanceType]; !ok {
+			return fmt.Errorf("Instance type %s is not available as a spot instance in %s", instanceType, config.Region)
+		}
 	}
-	return terraformClient, nil
+	return nil
+}
+
+func getAMI(region string) (string, error) {
+	if _, ok := amiMap[region]; !ok {
+		return "", fmt.Errorf("Unknown region %s. Need to manually specify AMI.", region)
+	}
+	return amiMap[region], nil
 }
@@ -0,0 +1,102 @@
+package stack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/dan-v/copperheados-stack/checker"
+)
+
+// checkerConfig is the config of the build checker of a stack, without the
+// ids of the resources it gets from the environment of its Lambda function.
+func checkerConfig(config StackConfig) checker.Config {
+	var window *checker.Window
+	if config.BuildWindow != nil {
+		window = &checker.Window{Start: config.BuildWindow.Start, End: config.BuildWindow.End}
+	}
+	return checker.Config{
+		Name:            config.Name,
+		Region:          config.Region,
+		Device:          config.Device,
+		Version:         config.Version,
+		AMI:             config.AMI,
+		SSHKey:          config.SSHKey,
+		SpotPrice:       config.SpotPrice,
+		InstanceTypes:   config.InstanceTypes,
+		VolumeSize:      int64(config.VolumeSize),
+		VolumeType:      config.VolumeType,
+		MaxBuildSeconds: int64(config.MaxBuildDuration.Seconds()),
+		PreventShutdown: config.PreventShutdown,
+		FallbackPolicy:  config.FallbackPolicy,
+		FallbackSeconds: int64(config.FallbackAfter.Seconds()),
+		MaxSpotPrice:    config.MaxSpotPrice,
+		BuildWindow:     window,
+		ReleaseURL:      config.ReleaseURL(),
+		S3Endpoint:      config.S3Endpoint,
+	}
+}
+
+// checkerBinary returns the copperheados-stack binary the build checker
+// Lambda function runs as its custom runtime. Lambda runs linux on amd64, so
+// unless this is such a binary a linux build of the same version has to be
+// given with --checker-binary.
+func checkerBinary(config StackConfig) ([]byte, error) {
+	path := config.CheckerBinary
+	if path == "" {
+		if runtime.GOOS != "linux" || runtime.GOARCH != "amd64" {
+			return nil, fmt.Errorf("The build checker Lambda function runs copperheados-stack for linux, pass the linux amd64 binary of copperheados-stack %s with --checker-binary", config.Version)
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to find the copperheados-stack binary: %v", err)
+		}
+		path = executable
+	}
+	binary, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read build checker binary: %v", err)
+	}
+	return binary, nil
+}
+
+// deployedChecker creates a checker from the config of the build checker
+// Lambda function of a deployed stack, so the CLI decides exactly like the
+// scheduled checks.
+func deployedChecker(config StackConfig) (*checker.Config, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+	lambdaClient := lambda.New(sess, &aws.Config{Region: &config.Region})
+	functionName := config.Name + "-build"
+	output, err := lambdaClient.GetFunctionConfiguration(&lambda.GetFunctionConfigurationInput{FunctionName: &functionName})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get Lambda function %s: %v", functionName, err)
+	}
+	if output.Environment == nil {
+		return nil, fmt.Errorf("Lambda function %s has no config, deploy the stack again", functionName)
+	}
+	deployed, err := checker.ConfigFromVariables(aws.StringValueMap(output.Environment.Variables))
+	if err != nil {
+		return nil, fmt.Errorf("Lambda function %s has no usable config, deploy the stack again: %v", functionName, err)
+	}
+	return deployed, nil
+}
+
+// AWSBuild runs the build checker of a stack, which starts a build when there
+// is a new release, or always when force is set.
+func AWSBuild(config StackConfig, force bool) error {
+	deployed, err := deployedChecker(config)
+	if err != nil {
+		return err
+	}
+	buildChecker, err := checker.New(deployed)
+	if err != nil {
+		return err
+	}
+	return buildChecker.Run(checker.ActionCheck, force)
+}
@@ -0,0 +1,186 @@
+package stack
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/costexplorer"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	costCategoryEC2          = "EC2"
+	costCategoryEBS          = "EBS"
+	costCategoryS3           = "S3"
+	costCategoryDataTransfer = "DATA TRANSFER"
+	costCategoryOther        = "OTHER"
+)
+
+var costCategories = []string{costCategoryEC2, costCategoryEBS, costCategoryS3, costCategoryDataTransfer, costCategoryOther}
+
+// build logs are uploaded once per build as <device>/<unix timestamp>
+var buildLogKey = regexp.MustCompile(`^[a-z]+/[0-9]+$`)
+
+type monthlyCost struct {
+	month      string
+	categories map[string]float64
+	builds     int
+}
+
+func (cost monthlyCost) total() float64 {
+	total := 0.0
+	for _, amount := range cost.categories {
+		total += amount
+	}
+	return total
+}
+
+// AWSCost prints the monthly spend of a stack broken down by EC2, EBS, S3 and
+// data transfer, based on the stack tag. The tag has to be activated as a cost
+// allocation tag in the billing console before Cost Explorer reports on it.
+func AWSCost(config StackConfig, months int) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	// cost explorer is only available in us-east-1
+	ceClient := costexplorer.New(sess, &aws.Config{Region: aws.String("us-east-1")})
+
+	now := time.Now().UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -(months - 1), 0)
+	end := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if !end.After(start) {
+		end = start.AddDate(0, 0, 1)
+	}
+
+	log.Infof("Querying Cost Explorer for resources tagged %s=%s", StackTagKey, config.Name)
+	costs := map[string]*monthlyCost{}
+	input := &costexplorer.GetCostAndUsageInput{
+		TimePeriod: &costexplorer.DateInterval{
+			Start: aws.String(start.Format("2006-01-02")),
+			End:   aws.String(end.Format("2006-01-02")),
+		},
+		Granularity: aws.String(costexplorer.GranularityMonthly),
+		Metrics:     aws.StringSlice([]string{"UnblendedCost"}),
+		Filter: &costexplorer.Expression{
+			Tags: &costexplorer.TagValues{
+				Key:    aws.String(StackTagKey),
+				Values: aws.StringSlice([]string{config.Name}),
+			},
+		},
+		GroupBy: []*costexplorer.GroupDefinition{
+			{Type: aws.String(costexplorer.GroupDefinitionTypeDimension), Key: aws.String("SERVICE")},
+			{Type: aws.String(costexplorer.GroupDefinitionTypeDimension), Key: aws.String("USAGE_TYPE")},
+		},
+	}
+	for {
+		output, err := ceClient.GetCostAndUsage(input)
+		if err != nil {
+			return fmt.Errorf("Failed to get cost and usage: %v", err)
+		}
+		for _, result := range output.ResultsByTime {
+			month := aws.StringValue(result.TimePeriod.Start)[:7]
+			if _, ok := costs[month]; !ok {
+				costs[month] = &monthlyCost{month: month, categories: map[string]float64{}}
+			}
+			for _, group := range result.Groups {
+				if len(group.Keys) != 2 {
+					continue
+				}
+				amount, err := strconv.ParseFloat(aws.StringValue(group.Metrics["UnblendedCost"].Amount), 64)
+				if err != nil {
+					return fmt.Errorf("Unexpected cost amount for %v: %v", aws.StringValueSlice(group.Keys), err)
+				}
+				category := costCategory(aws.StringValue(group.Keys[0]), aws.StringValue(group.Keys[1]))
+				costs[month].categories[category] += amount
+			}
+		}
+		if output.NextPageToken == nil {
+			break
+		}
+		input.NextPageToken = output.NextPageToken
+	}
+
+	err = countBuilds(config, costs)
+	if err != nil {
+		return err
+	}
+
+	printCosts(costs)
+	return nil
+}
+
+func costCategory(service, usageType string) string {
+	switch {
+	case strings.Contains(usageType, "DataTransfer"):
+		return costCategoryDataTransfer
+	case strings.Contains(usageType, "EBS:"):
+		return costCategoryEBS
+	case service == "Amazon Elastic Compute Cloud - Compute":
+		return costCategoryEC2
+	case service == "Amazon Simple Storage Service":
+		return costCategoryS3
+	}
+	return costCategoryOther
+}
+
+// countBuilds counts the build logs uploaded to the logs bucket per month.
+func countBuilds(config StackConfig, costs map[string]*monthlyCost) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	s3Client := s3.New(sess, s3Config(config))
+
+	err = s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(config.Name + "-logs"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if !buildLogKey.MatchString(aws.StringValue(object.Key)) {
+				continue
+			}
+			month := aws.TimeValue(object.LastModified).UTC().Format("2006-01")
+			if cost, ok := costs[month]; ok {
+				cost.builds++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to list build logs in %s-logs: %v", config.Name, err)
+	}
+	return nil
+}
+
+func printCosts(costs map[string]*monthlyCost) {
+	months := []string{}
+	for month := range costs {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "MONTH\t%s\tTOTAL\tBUILDS\tPER BUILD\t\n", strings.Join(costCategories, "\t"))
+	for _, month := range months {
+		cost := costs[month]
+		fmt.Fprintf(w, "%s\t", month)
+		for _, category := range costCategories {
+			fmt.Fprintf(w, "$%.2f\t", cost.categories[category])
+		}
+		perBuild := "-"
+		if cost.builds > 0 {
+			buildCost := cost.categories[costCategoryEC2] + cost.categories[costCategoryEBS] + cost.categories[costCategoryDataTransfer]
+			perBuild = fmt.Sprintf("$%.2f", buildCost/float64(cost.builds))
+		}
+		fmt.Fprintf(w, "$%.2f\t%d\t%s\t\n", cost.total(), cost.builds, perBuild)
+	}
+	w.Flush()
+}
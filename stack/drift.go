@@ -0,0 +1,197 @@
+package stack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// AWSDrift compares a deployed stack with what a deploy with the given config
+// would create, without changing anything. Terraform refreshes the resources
+// it manages and prints the changes an apply would make, which includes edits
+// made in the console. The build script and the Lambda code are compared with
+// what this version of copperheados-stack renders. It returns true when
+// anything differs.
+func AWSDrift(config StackConfig) (bool, error) {
+	err := checkAWSCreds(config)
+	if err != nil {
+		return false, err
+	}
+
+	if config.AMI == "" {
+		ami, err := getAMI(config.Region)
+		if err != nil {
+			return false, err
+		}
+		config.AMI = ami
+	}
+
+	config.OTAZone, err = otaZone(config)
+	if err != nil {
+		return false, err
+	}
+
+	terraformConf, err := generateTerraformConfig(config)
+	if err != nil {
+		return false, fmt.Errorf("Failed to generate config: %v", err)
+	}
+	defer terraformConf.TempDir.Cleanup()
+
+	nativeState, err := nativeStateExists(config)
+	if err != nil {
+		return false, err
+	}
+
+	drifted := false
+	if nativeState {
+		// the native engine only knows the settings it applied, not the current ones
+		log.Warnf("Stack %s is managed by the native engine, changes made to its resources outside of copperheados-stack can't be detected", config.Name)
+		err = writeStackFiles(terraformConf)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		log.Info("Comparing AWS resources with the terraform config")
+		terraformClient, err := NewTerraformClient(terraformConf, os.Stdout, os.Stderr)
+		if err != nil {
+			return false, fmt.Errorf("Failed to create client: %v", err)
+		}
+		changes, err := terraformClient.Plan()
+		if err != nil {
+			return false, fmt.Errorf("Failed to plan terraform changes: %v", err)
+		}
+		if changes {
+			fmt.Println("AWS resources differ from the terraform config, see the plan above")
+			drifted = true
+		}
+	}
+
+	scriptDrift, err := scriptDrift(config, terraformConf)
+	if err != nil {
+		return false, err
+	}
+	if scriptDrift != "" {
+		fmt.Println(scriptDrift)
+		drifted = true
+	}
+
+	lambdaDrift, err := lambdaDrift(config, terraformConf)
+	if err != nil {
+		return false, err
+	}
+	for _, line := range lambdaDrift {
+		fmt.Println(line)
+		drifted = true
+	}
+
+	if drifted {
+		log.Warnf("Stack %s has drifted, deploy it again to revert the changes", config.Name)
+	} else {
+		log.Infof("Stack %s matches its config", config.Name)
+	}
+	return drifted, nil
+}
+
+// scriptDrift describes how the deployed build script differs from the one
+// this version renders, or returns an empty string when they are the same.
+func scriptDrift(config StackConfig, terraformConf *TerraformConfig) (string, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return "", err
+	}
+	s3Client := s3.New(sess, s3Config(config))
+
+	bucket := config.Name + "-script"
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    aws.String(ShellScriptFilename),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return fmt.Sprintf("Build script s3://%s/%s is missing", bucket, ShellScriptFilename), nil
+		}
+		return "", fmt.Errorf("Failed to get build script from bucket %s: %v", bucket, err)
+	}
+	defer output.Body.Close()
+	deployed, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read build script from bucket %s: %v", bucket, err)
+	}
+
+	line := firstDifferentLine(deployed, terraformConf.ShellScriptBytes)
+	if line == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("Build script s3://%s/%s differs from the rendered script at line %d", bucket, ShellScriptFilename, line), nil
+}
+
+// firstDifferentLine returns the 1-based number of the first line that
+// differs between a and b, or 0 when they are equal.
+func firstDifferentLine(a, b []byte) int {
+	if bytes.Equal(a, b) {
+		return 0
+	}
+	aLines := bytes.Split(a, []byte("\n"))
+	bLines := bytes.Split(b, []byte("\n"))
+	for i := 0; i < len(aLines) && i < len(bLines); i++ {
+		if !bytes.Equal(aLines[i], bLines[i]) {
+			return i + 1
+		}
+	}
+	if len(aLines) < len(bLines) {
+		return len(aLines) + 1
+	}
+	return len(bLines) + 1
+}
+
+// lambdaDrift compares the code of the deployed Lambda functions with the
+// zips this version renders. Lambda keeps the base64 encoded sha256 of the
+// deployed zip, which only matches because the zips are built
+// deterministically.
+func lambdaDrift(config StackConfig, terraformConf *TerraformConfig) ([]string, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+	lambdaClient := lambda.New(sess, &aws.Config{Region: &config.Region})
+
+	functions := []struct {
+		name    string
+		zipFile string
+	}{
+		{config.Name + "-build", terraformConf.TempDir.Path(LambdaBuildZipFilename)},
+		{config.Name + "-notify", terraformConf.TempDir.Path(LambdaNotifyZipFilename)},
+	}
+	var drift []string
+	for _, function := range functions {
+		zip, err := ioutil.ReadFile(function.zipFile)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(zip)
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+
+		output, err := lambdaClient.GetFunction(&lambda.GetFunctionInput{FunctionName: aws.String(function.name)})
+		if err != nil {
+			if isNotFound(err) {
+				drift = append(drift, fmt.Sprintf("Lambda function %s is missing", function.name))
+				continue
+			}
+			return nil, fmt.Errorf("Failed to get Lambda function %s: %v", function.name, err)
+		}
+		deployed := aws.StringValue(output.Configuration.CodeSha256)
+		if deployed != expected {
+			drift = append(drift, fmt.Sprintf("Lambda function %s code differs from the rendered code (deployed sha256 %s, rendered %s)",
+				function.name, deployed, expected))
+		}
+	}
+	return drift, nil
+}
@@ -0,0 +1,240 @@
+package stack
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/pricing"
+	log "github.com/sirupsen/logrus"
+)
+
+// Pricing API location names of the supported regions
+var pricingLocations = map[string]string{
+	"ap-northeast-1": "Asia Pacific (Tokyo)",
+	"ap-northeast-2": "Asia Pacific (Seoul)",
+	"ap-south-1":     "Asia Pacific (Mumbai)",
+	"ap-southeast-1": "Asia Pacific (Singapore)",
+	"ap-southeast-2": "Asia Pacific (Sydney)",
+	"ca-central-1":   "Canada (Central)",
+	"eu-central-1":   "EU (Frankfurt)",
+	"eu-west-1":      "EU (Ireland)",
+	"eu-west-2":      "EU (London)",
+	"eu-west-3":      "EU (Paris)",
+	"sa-east-1":      "South America (Sao Paulo)",
+	"us-east-1":      "US East (N. Virginia)",
+	"us-east-2":      "US East (Ohio)",
+	"us-west-1":      "US West (N. California)",
+	"us-west-2":      "US West (Oregon)",
+}
+
+// Approximate sizes in GB of the artifacts a build uploads to the release bucket
+const (
+	otaSizeGB           = 1.0
+	incrementalSizeGB   = 0.3
+	targetFilesSizeGB   = 1.5
+	factoryImageSizeGB  = 1.2
+	chromiumSizeGB      = 0.1
+	hoursPerMonth       = 730
+	spotHistoryDuration = 7 * 24 * time.Hour
+)
+
+// EstimateUsage describes the expected build activity of a stack.
+type EstimateUsage struct {
+	BuildsPerMonth float64
+	BuildDuration  time.Duration
+}
+
+type estimateLine struct {
+	item      string
+	quantity  string
+	unitPrice string
+	cost      float64
+}
+
+// AWSEstimate projects the monthly cost of a stack from the Pricing API and the
+// recent spot price history of the configured instance types.
+func AWSEstimate(config StackConfig, usage EstimateUsage) error {
+	location, ok := pricingLocations[config.Region]
+	if !ok {
+		return fmt.Errorf("Unknown region %s. Pricing is not available.", config.Region)
+	}
+
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	// the pricing api is only available in us-east-1 and ap-south-1
+	pricingClient := pricing.New(sess, &aws.Config{Region: aws.String("us-east-1")})
+	ec2Client := ec2.New(sess, &aws.Config{Region: &config.Region})
+
+	log.Infof("Looking up spot price history of %v in %s", config.InstanceTypes, config.Region)
+	spotPrices, err := averageSpotPrices(ec2Client, config.InstanceTypes, spotHistoryDuration)
+	if err != nil {
+		return err
+	}
+	spotType, spotPrice := "", math.MaxFloat64
+	for _, instanceType := range config.InstanceTypes {
+		price, ok := spotPrices[instanceType]
+		if !ok {
+			return fmt.Errorf("No spot price history for %s in %s", instanceType, config.Region)
+		}
+		if price < spotPrice {
+			spotType, spotPrice = instanceType, price
+		}
+	}
+
+	log.Infof("Looking up on demand, EBS and S3 prices for %s", location)
+	onDemand, err := onDemandPrice(pricingClient, location, config.InstanceTypes[0])
+	if err != nil {
+		return err
+	}
+	ebsPrice, err := lookupPrice(pricingClient, "AmazonEC2", map[string]string{
+		"location":      location,
+		"productFamily": "Storage",
+		"volumeApiName": config.VolumeType,
+	})
+	if err != nil {
+		return err
+	}
+	s3Price, err := lookupPrice(pricingClient, "AmazonS3", map[string]string{
+		"location":     location,
+		"storageClass": "General Purpose",
+		"volumeType":   "Standard",
+	})
+	if err != nil {
+		return err
+	}
+
+	buildHours := usage.BuildsPerMonth * usage.BuildDuration.Hours()
+	// only the latest ota and factory image are kept, target files and
+	// incrementals accumulate until they expire
+	retainedBuilds := usage.BuildsPerMonth * float64(config.ReleaseRetention) / 30
+	storageGB := otaSizeGB + factoryImageSizeGB + chromiumSizeGB + retainedBuilds*(targetFilesSizeGB+incrementalSizeGB)
+
+	lines := []estimateLine{
+		{
+			item:      fmt.Sprintf("EC2 spot (%s)", spotType),
+			quantity:  fmt.Sprintf("%.1f hours", buildHours),
+			unitPrice: fmt.Sprintf("$%.4f/hour", spotPrice),
+			cost:      buildHours * spotPrice,
+		},
+		{
+			item:      fmt.Sprintf("EBS %s root volume", config.VolumeType),
+			quantity:  fmt.Sprintf("%d GB for %.1f hours", config.VolumeSize, buildHours),
+			unitPrice: fmt.Sprintf("$%.4f/GB-month", ebsPrice),
+			cost:      float64(config.VolumeSize) * ebsPrice * buildHours / hoursPerMonth,
+		},
+		{
+			item:      "S3 release storage",
+			quantity:  fmt.Sprintf("%.1f GB", storageGB),
+			unitPrice: fmt.Sprintf("$%.4f/GB-month", s3Price),
+			cost:      storageGB * s3Price,
+		},
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "ITEM\tQUANTITY\tPRICE\tMONTHLY COST\n")
+	total := 0.0
+	for _, line := range lines {
+		fmt.Fprintf(w, "%s\t%s\t%s\t$%.2f\n", line.item, line.quantity, line.unitPrice, line.cost)
+		total += line.cost
+	}
+	fmt.Fprintf(w, "TOTAL\t\t\t$%.2f\n", total)
+	w.Flush()
+
+	fmt.Printf("\nAssumes %.1f builds a month taking %s each, with releases retained for %d days.\n",
+		usage.BuildsPerMonth, usage.BuildDuration, config.ReleaseRetention)
+	fmt.Printf("Spot price is the %s average over the last %s. Building on demand (%s) instead would cost $%.2f a month for EC2.\n",
+		spotType, spotHistoryDuration, config.InstanceTypes[0], buildHours*onDemand)
+	fmt.Println("Months with a Chromium rebuild take considerably longer, estimate those with a higher --build-duration.")
+	return nil
+}
+
+// averageSpotPrices returns the average Linux spot price over all availability
+// zones of each instance type during the given duration.
+func averageSpotPrices(ec2Client *ec2.EC2, instanceTypes []string, duration time.Duration) (map[string]float64, error) {
+	sums := map[string]float64{}
+	counts := map[string]int{}
+	err := ec2Client.DescribeSpotPriceHistoryPages(&ec2.DescribeSpotPriceHistoryInput{
+		InstanceTypes:       aws.StringSlice(instanceTypes),
+		ProductDescriptions: aws.StringSlice([]string{"Linux/UNIX"}),
+		StartTime:           aws.Time(time.Now().Add(-duration)),
+	}, func(page *ec2.DescribeSpotPriceHistoryOutput, lastPage bool) bool {
+		for _, history := range page.SpotPriceHistory {
+			price, err := strconv.ParseFloat(aws.StringValue(history.SpotPrice), 64)
+			if err != nil {
+				continue
+			}
+			sums[aws.StringValue(history.InstanceType)] += price
+			counts[aws.StringValue(history.InstanceType)]++
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to describe spot price history: %v", err)
+	}
+
+	averages := map[string]float64{}
+	for instanceType, sum := range sums {
+		averages[instanceType] = sum / float64(counts[instanceType])
+	}
+	return averages, nil
+}
+
+func onDemandPrice(pricingClient *pricing.Pricing, location, instanceType string) (float64, error) {
+	return lookupPrice(pricingClient, "AmazonEC2", map[string]string{
+		"location":        location,
+		"instanceType":    instanceType,
+		"operatingSystem": "Linux",
+		"tenancy":         "Shared",
+		"preInstalledSw":  "NA",
+		"capacitystatus":  "Used",
+	})
+}
+
+// lookupPrice returns the first tier on demand USD price of the single product
+// matching the given attributes.
+func lookupPrice(pricingClient *pricing.Pricing, serviceCode string, attributes map[string]string) (float64, error) {
+	filters := []*pricing.Filter{}
+	for field, value := range attributes {
+		filters = append(filters, &pricing.Filter{
+			Type:  aws.String(pricing.FilterTypeTermMatch),
+			Field: aws.String(field),
+			Value: aws.String(value),
+		})
+	}
+
+	output, err := pricingClient.GetProducts(&pricing.GetProductsInput{
+		ServiceCode: aws.String(serviceCode),
+		Filters:     filters,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get %s prices for %v: %v", serviceCode, attributes, err)
+	}
+	if len(output.PriceList) == 0 {
+		return 0, fmt.Errorf("No %s prices found for %v", serviceCode, attributes)
+	}
+
+	terms, _ := output.PriceList[0]["terms"].(map[string]interface{})
+	onDemand, _ := terms["OnDemand"].(map[string]interface{})
+	for _, offer := range onDemand {
+		offer, _ := offer.(map[string]interface{})
+		dimensions, _ := offer["priceDimensions"].(map[string]interface{})
+		for _, dimension := range dimensions {
+			dimension, _ := dimension.(map[string]interface{})
+			if beginRange, ok := dimension["beginRange"]; ok && beginRange != "0" {
+				continue
+			}
+			pricePerUnit, _ := dimension["pricePerUnit"].(map[string]interface{})
+			usd, _ := pricePerUnit["USD"].(string)
+			return strconv.ParseFloat(usd, 64)
+		}
+	}
+	return 0, fmt.Errorf("Unexpected %s price format for %v", serviceCode, attributes)
+}
@@ -0,0 +1,192 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Build event types emitted by the build script
+const (
+	BuildEventStarted       = "build_started"
+	BuildEventFinished      = "build_finished"
+	BuildEventFailed        = "build_failed"
+	BuildEventStageStarted  = "stage_started"
+	BuildEventStageFinished = "stage_finished"
+)
+
+// BuildEvent is a single structured event of a build, stored as JSON under
+// <name>-logs/<device>/builds/<build id>/events/.
+type BuildEvent struct {
+	BuildID         string    `json:"build_id"`
+	Device          string    `json:"device"`
+	Event           string    `json:"event"`
+	Stage           string    `json:"stage"`
+	Timestamp       time.Time `json:"timestamp"`
+	ElapsedSeconds  int64     `json:"elapsed_seconds"`
+	StageSeconds    int64     `json:"stage_seconds"`
+	DiskUsedGB      int       `json:"disk_used_gb"`
+	DiskAvailableGB int       `json:"disk_available_gb"`
+	LaunchPath      string    `json:"launch_path"`
+	InstanceType    string    `json:"instance_type"`
+	SpotPrice       string    `json:"spot_price"`
+	OfficialDate    string    `json:"official_date"`
+	Error           string    `json:"error"`
+}
+
+func (event BuildEvent) done() bool {
+	return event.Event == BuildEventFinished || event.Event == BuildEventFailed
+}
+
+func (event BuildEvent) String() string {
+	elapsed := time.Duration(event.ElapsedSeconds) * time.Second
+	disk := fmt.Sprintf("disk %dG used, %dG free", event.DiskUsedGB, event.DiskAvailableGB)
+	switch event.Event {
+	case BuildEventStarted:
+		instance := event.LaunchPath
+		if event.InstanceType != "" {
+			instance += " " + event.InstanceType
+		}
+		if event.SpotPrice != "" {
+			instance += " at $" + event.SpotPrice
+		}
+		return fmt.Sprintf("[%s] build %s of %s (%s) started on %s instance, %s", elapsed, event.BuildID, event.Device, event.OfficialDate, instance, disk)
+	case BuildEventStageStarted:
+		return fmt.Sprintf("[%s] %s started, %s", elapsed, event.Stage, disk)
+	case BuildEventStageFinished:
+		return fmt.Sprintf("[%s] %s finished in %s, %s", elapsed, event.Stage, time.Duration(event.StageSeconds)*time.Second, disk)
+	case BuildEventFinished:
+		return fmt.Sprintf("[%s] build %s finished successfully", elapsed, event.BuildID)
+	case BuildEventFailed:
+		return fmt.Sprintf("[%s] build %s FAILED in stage %s: %s", elapsed, event.BuildID, event.Stage, event.Error)
+	}
+	return fmt.Sprintf("[%s] %s", elapsed, event.Event)
+}
+
+func buildEventsPrefix(device string) string {
+	return device + "/builds/"
+}
+
+// AWSWatch follows the current build of a device until it finishes, printing
+// every build event along with the running stage and elapsed time.
+func AWSWatch(config StackConfig, device string, interval time.Duration) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	s3Client := s3.New(sess, s3Config(config))
+	logsBucket := config.Name + "-logs"
+
+	buildID := ""
+	seen := map[string]bool{}
+	var last *BuildEvent
+	for {
+		currentID, err := currentBuildID(s3Client, logsBucket, device)
+		if err != nil {
+			return err
+		}
+		if currentID == "" {
+			log.Infof("No build of %s found yet, waiting for one to start", device)
+		} else if currentID != buildID {
+			buildID = currentID
+			seen = map[string]bool{}
+			last = nil
+			log.Infof("Watching build %s of %s", buildID, device)
+		}
+
+		if buildID != "" {
+			events, err := buildEvents(s3Client, logsBucket, device, buildID, seen)
+			if err != nil {
+				return err
+			}
+			for i := range events {
+				fmt.Println(events[i])
+				last = &events[i]
+			}
+			if last != nil && last.done() {
+				if last.Event == BuildEventFailed {
+					return fmt.Errorf("Build %s of %s failed in stage %s", buildID, device, last.Stage)
+				}
+				return nil
+			}
+			if last != nil && len(events) == 0 {
+				started := last.Timestamp.Add(-time.Duration(last.ElapsedSeconds) * time.Second)
+				stage := last.Stage
+				if stage == "" {
+					stage = "between stages"
+				}
+				log.Infof("Build %s running for %s, current stage: %s", buildID, time.Since(started).Round(time.Second), stage)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func currentBuildID(s3Client *s3.S3, bucket, device string) (string, error) {
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    aws.String(buildEventsPrefix(device) + "current"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return "", nil
+		}
+		return "", fmt.Errorf("Failed to get current build from bucket %s: %v", bucket, err)
+	}
+	defer output.Body.Close()
+	body, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// buildEvents returns the events of a build that are not in seen yet, in the
+// order they were emitted, and adds them to seen.
+func buildEvents(s3Client *s3.S3, bucket, device, buildID string, seen map[string]bool) ([]BuildEvent, error) {
+	keys := []string{}
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: aws.String(buildEventsPrefix(device) + buildID + "/events/"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if !seen[aws.StringValue(object.Key)] {
+				keys = append(keys, aws.StringValue(object.Key))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list events of build %s in bucket %s: %v", buildID, bucket, err)
+	}
+	// keys start with a zero padded sequence number
+	sort.Strings(keys)
+
+	events := []BuildEvent{}
+	for _, key := range keys {
+		output, err := s3Client.GetObject(&s3.GetObjectInput{
+			Bucket: &bucket,
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get build event %s: %v", key, err)
+		}
+		event := BuildEvent{}
+		err = json.NewDecoder(output.Body).Decode(&event)
+		output.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse build event %s: %v", key, err)
+		}
+		seen[key] = true
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -0,0 +1,264 @@
+package stack
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/resourcegroupstaggingapi"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// stackBucketSuffixes are the buckets every stack has next to its state bucket
+var stackBucketSuffixes = []string{"-keys", "-release", "-script", "-logs"}
+
+// AWSList prints the stacks in the account. Stacks are found by their bucket
+// layout, a bucket holding the state of a stack with the keys, release, script
+// and logs buckets of the same name next to it, and by the chos:stack tag of
+// their resources, which also finds stacks keeping their buckets on an S3
+// compatible service. Only stacks in region are listed unless region is empty.
+func AWSList(region string) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	stacks, err := bucketStacks(sess, region)
+	if err != nil {
+		return err
+	}
+	tagged, err := taggedStacks(sess, region)
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for _, config := range stacks {
+		found[config.Name] = true
+	}
+	for _, config := range tagged {
+		if !found[config.Name] {
+			found[config.Name] = true
+			stacks = append(stacks, config)
+		}
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		return stacks[i].Name < stacks[j].Name
+	})
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tREGION\tDEVICES\tVERSION\tLAST BUILD\tSTATUS\n")
+	for _, config := range stacks {
+		summary, err := summarizeStack(config)
+		if err != nil {
+			log.Warnf("Failed to summarize stack %s: %v", config.Name, err)
+			summary = &stackSummary{devices: []string{"-"}, version: "unknown", lastBuild: "-", status: "unknown"}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", config.Name, config.Region, strings.Join(summary.devices, ","),
+			summary.version, summary.lastBuild, summary.status)
+	}
+	return w.Flush()
+}
+
+// bucketStacks returns the stacks found by their bucket layout on AWS S3.
+func bucketStacks(sess *session.Session, region string) ([]StackConfig, error) {
+	// the bucket list is global, any region works
+	listRegion := region
+	if listRegion == "" {
+		listRegion = "us-east-1"
+	}
+	s3Client := s3.New(sess, &aws.Config{Region: &listRegion})
+	output, err := s3Client.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list S3 buckets: %v", err)
+	}
+
+	buckets := map[string]bool{}
+	for _, bucket := range output.Buckets {
+		buckets[aws.StringValue(bucket.Name)] = true
+	}
+	stacks := []StackConfig{}
+	for name := range buckets {
+		if !isStackBuckets(name, buckets) {
+			continue
+		}
+		location, err := s3Client.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(name)})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get region of bucket %s: %v", name, err)
+		}
+		stackRegion := s3.NormalizeBucketLocation(aws.StringValue(location.LocationConstraint))
+		if region != "" && stackRegion != region {
+			continue
+		}
+
+		config := StackConfig{Name: name, Region: stackRegion}
+		isStack, err := hasStackState(config)
+		if err != nil {
+			return nil, err
+		}
+		if isStack {
+			stacks = append(stacks, config)
+		}
+	}
+	return stacks, nil
+}
+
+// taggedStacks returns the stacks with resources tagged chos:stack in region,
+// or in every supported region when region is empty. The S3 endpoint of a
+// stack is taken from its build checker, so its buckets can be read.
+func taggedStacks(sess *session.Session, region string) ([]StackConfig, error) {
+	regions := []string{region}
+	if region == "" {
+		regions = []string{}
+		for r := range amiMap {
+			regions = append(regions, r)
+		}
+		sort.Strings(regions)
+	}
+
+	stacks := []StackConfig{}
+	for _, r := range regions {
+		taggingClient := resourcegroupstaggingapi.New(sess, &aws.Config{Region: aws.String(r)})
+		names := map[string]bool{}
+		err := taggingClient.GetResourcesPages(&resourcegroupstaggingapi.GetResourcesInput{
+			TagFilters: []*resourcegroupstaggingapi.TagFilter{{Key: aws.String(StackTagKey)}},
+		}, func(page *resourcegroupstaggingapi.GetResourcesOutput, lastPage bool) bool {
+			for _, resource := range page.ResourceTagMappingList {
+				for _, tag := range resource.Tags {
+					if aws.StringValue(tag.Key) == StackTagKey {
+						names[aws.StringValue(tag.Value)] = true
+					}
+				}
+			}
+			return true
+		})
+		if err != nil {
+			if region != "" {
+				return nil, fmt.Errorf("Failed to get resources tagged %s in %s: %v", StackTagKey, r, err)
+			}
+			// regions that aren't enabled for the account can't be queried
+			log.Warnf("Failed to get resources tagged %s in %s: %v", StackTagKey, r, err)
+			continue
+		}
+		for name := range names {
+			config := StackConfig{Name: name, Region: r}
+			if deployed, err := deployedChecker(config); err == nil {
+				config.S3Endpoint = deployed.S3Endpoint
+			}
+			stacks = append(stacks, config)
+		}
+	}
+	return stacks, nil
+}
+
+func isStackBuckets(name string, buckets map[string]bool) bool {
+	for _, suffix := range stackBucketSuffixes {
+		if !buckets[name+suffix] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasStackState checks the state bucket of a stack for the state of either
+// engine.
+func hasStackState(config StackConfig) (bool, error) {
+	s3Client, err := stateS3Client(config)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range []string{terraformStateKey, nativeStateKey} {
+		_, err := s3Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: &config.Name,
+			Key:    aws.String(key),
+		})
+		if err == nil {
+			return true, nil
+		}
+		if !isNotFound(err) {
+			return false, fmt.Errorf("Failed to check for %s in bucket %s: %v", key, config.Name, err)
+		}
+	}
+	return false, nil
+}
+
+type stackSummary struct {
+	devices   []string
+	version   string
+	lastBuild string
+	status    string
+}
+
+func summarizeStack(config StackConfig) (*stackSummary, error) {
+	summary := &stackSummary{version: "unknown", lastBuild: "-", status: "-"}
+
+	meta, err := loadStackMeta(config)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+	s3Client := s3.New(sess, s3Config(config))
+	logsBucket := config.Name + "-logs"
+
+	if meta != nil {
+		summary.version = meta.ToolVersion
+		summary.devices = meta.Devices
+	} else {
+		// stacks deployed before stack.json keep their builds under a prefix per device
+		output, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:    &logsBucket,
+			Delimiter: aws.String("/"),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list devices in bucket %s: %v", logsBucket, err)
+		}
+		for _, prefix := range output.CommonPrefixes {
+			summary.devices = append(summary.devices, strings.TrimSuffix(aws.StringValue(prefix.Prefix), "/"))
+		}
+	}
+
+	for _, device := range summary.devices {
+		buildID, err := currentBuildID(s3Client, logsBucket, device)
+		if err != nil {
+			return nil, err
+		}
+		if buildID == "" {
+			continue
+		}
+		events, err := buildEvents(s3Client, logsBucket, device, buildID, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 {
+			continue
+		}
+		first, last := events[0], events[len(events)-1]
+		started := first.Timestamp.Local().Format("2006-01-02 15:04")
+		// the most recent build of all devices
+		if summary.lastBuild != "-" && started < summary.lastBuild {
+			continue
+		}
+		summary.lastBuild = started
+		switch last.Event {
+		case BuildEventFinished:
+			summary.status = "succeeded"
+		case BuildEventFailed:
+			summary.status = "failed in " + last.Stage
+		default:
+			summary.status = "running"
+		}
+		if len(summary.devices) > 1 {
+			summary.status = device + " " + summary.status
+		}
+	}
+	if len(summary.devices) == 0 {
+		summary.devices = []string{"-"}
+	}
+	return summary, nil
+}
@@ -0,0 +1,59 @@
+package stack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+
+	"github.com/dan-v/copperheados-stack/templates"
+	log "github.com/sirupsen/logrus"
+)
+
+// LocalBuild renders the build script for building on this machine instead of
+// an ec2 instance and runs it, unless renderOnly is set. Keys, releases and
+// logs are kept in the keys, release and logs directories of dir, laid out
+// like the buckets of a stack so the release can be published to one later.
+func LocalBuild(config StackConfig, dir string, renderOnly bool) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create build directory %s: %v", dir, err)
+	}
+	config.LocalBuildDir = dir
+
+	script, err := renderTemplate(templates.CopperheadShellScriptTemplate, config)
+	if err != nil {
+		return fmt.Errorf("Failed to render shell script: %v", err)
+	}
+	scriptPath := filepath.Join(dir, ShellScriptFilename)
+	err = ioutil.WriteFile(scriptPath, script, 0755)
+	if err != nil {
+		return err
+	}
+	log.Infof("Rendered build script to %s", scriptPath)
+	if renderOnly {
+		return nil
+	}
+
+	if runtime.GOOS != "linux" {
+		return fmt.Errorf("Local builds require Linux, copy %s to a Linux machine and run it there", scriptPath)
+	}
+	log.Infof("Building %s in %s, this will take several hours", config.Device, dir)
+	cmd := exec.Command("bash", scriptPath, config.Device, "-A", "-l", "local")
+	cmd.Dir = dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Local build failed, see %s: %v", filepath.Join(dir, "build.log"), err)
+	}
+	log.Infof("Build finished, publish the release in %s with the publish command", filepath.Join(dir, "release"))
+	return nil
+}
@@ -0,0 +1,124 @@
+package stack
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// LogRetentionDays are the retention periods CloudWatch Logs accepts.
+var LogRetentionDays = []int{1, 3, 5, 7, 14, 30, 60, 90, 120, 150, 180, 365, 400, 545, 731, 1827, 3653}
+
+const logFollowInterval = 10 * time.Second
+
+// ValidLogRetention reports whether days is a retention period supported by
+// CloudWatch Logs.
+func ValidLogRetention(days int) bool {
+	for _, valid := range LogRetentionDays {
+		if days == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func buildLogGroup(name string) string {
+	return name + "-builds"
+}
+
+// AWSLogs prints the log of a build of a device, the current build unless a
+// build id is given. The log is read from the CloudWatch Logs stream the build
+// instance writes to while building, falling back to the copy archived in the
+// logs bucket once the stream has expired. With follow, new lines are printed
+// as they arrive until the build finishes.
+func AWSLogs(config StackConfig, device, buildID string, follow bool) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	logsClient := cloudwatchlogs.New(sess, &aws.Config{Region: &config.Region})
+	s3Client := s3.New(sess, s3Config(config))
+	logsBucket := config.Name + "-logs"
+
+	if buildID == "" {
+		buildID, err = currentBuildID(s3Client, logsBucket, device)
+		if err != nil {
+			return err
+		}
+		if buildID == "" {
+			return fmt.Errorf("No build of %s found in bucket %s", device, logsBucket)
+		}
+	}
+
+	input := &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(buildLogGroup(config.Name)),
+		LogStreamName: aws.String(device + "/" + buildID),
+		StartFromHead: aws.Bool(true),
+	}
+	for {
+		output, err := logsClient.GetLogEvents(input)
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cloudwatchlogs.ErrCodeResourceNotFoundException {
+				log.Infof("No log stream for build %s of %s, reading archived log", buildID, device)
+				return printArchivedLog(s3Client, logsBucket, device+"/"+buildID)
+			}
+			return fmt.Errorf("Failed to get log events of build %s: %v", buildID, err)
+		}
+		for _, event := range output.Events {
+			fmt.Println(aws.StringValue(event.Message))
+		}
+
+		// the forward token stays the same once the end of the stream is reached
+		if aws.StringValue(output.NextForwardToken) != aws.StringValue(input.NextToken) {
+			input.NextToken = output.NextForwardToken
+			continue
+		}
+		if !follow {
+			return nil
+		}
+		finished, err := archivedLogExists(s3Client, logsBucket, device+"/"+buildID)
+		if err != nil {
+			return err
+		}
+		if finished {
+			return nil
+		}
+		time.Sleep(logFollowInterval)
+	}
+}
+
+// archivedLogExists reports whether the build instance has copied its log to
+// the logs bucket, which it does when the build finishes.
+func archivedLogExists(s3Client *s3.S3, bucket, key string) (bool, error) {
+	_, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return false, nil
+		}
+		return false, fmt.Errorf("Failed to check for log %s in bucket %s: %v", key, bucket, err)
+	}
+	return true, nil
+}
+
+func printArchivedLog(s3Client *s3.S3, bucket, key string) error {
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to get log %s from bucket %s: %v", key, bucket, err)
+	}
+	defer output.Body.Close()
+	_, err = io.Copy(os.Stdout, output.Body)
+	return err
+}
@@ -0,0 +1,492 @@
+package stack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	log "github.com/sirupsen/logrus"
+)
+
+// nativeStateKey is the key of the state document of the native engine in the
+// stack bucket, next to the terraform state.
+const nativeStateKey = "native.state"
+
+const nativeStateVersion = 1
+
+type nativeState struct {
+	Version   int                   `json:"version"`
+	Resources []nativeResourceState `json:"resources"`
+}
+
+// nativeResourceState is a created resource. Resources are kept in the order
+// they were created in so they can be removed in reverse.
+type nativeResourceState struct {
+	Address string `json:"address"`
+	ID      string `json:"id"`
+	Hash    string `json:"hash"`
+}
+
+// nativeResource is a resource the native engine manages. Addresses and ids
+// are those of the terraform template, so terraform state can be migrated.
+type nativeResource struct {
+	address string
+	// inputs are everything the resource is created from, a change to them
+	// updates the resource
+	inputs func() interface{}
+	// apply creates the resource, or updates it when id is set, and returns
+	// its id
+	apply func(id string) (string, error)
+}
+
+// NativeClient provisions a stack directly with the AWS SDK instead of
+// running terraform. It reads the stack from the state document rather than
+// refreshing every resource, so a run without changes only takes a few
+// requests.
+type NativeClient struct {
+	config      *TerraformConfig
+	stackConfig StackConfig
+	state       *nativeState
+	ids         map[string]string
+
+	s3Client     *s3.S3
+	ec2Client    *ec2.EC2
+	iamClient    *iam.IAM
+	snsClient    *sns.SNS
+	lambdaClient *lambda.Lambda
+	logsClient   *cloudwatchlogs.CloudWatchLogs
+	cwClient     *cloudwatch.CloudWatch
+	eventsClient *cloudwatchevents.CloudWatchEvents
+	dynamoClient *dynamodb.DynamoDB
+}
+
+func NewNativeClient(config *TerraformConfig, stackConfig StackConfig) (*NativeClient, error) {
+	// the native engine only covers the resources every stack has
+	if config.OTADomain != "" {
+		return nil, fmt.Errorf("--ota-domain is not supported by the native engine, use --engine %s", EngineTerraform)
+	}
+
+	if err := writeStackFiles(config); err != nil {
+		return nil, err
+	}
+
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+	region := &aws.Config{Region: &config.Region}
+	return &NativeClient{
+		config:       config,
+		stackConfig:  stackConfig,
+		ids:          map[string]string{},
+		s3Client:     s3.New(sess, s3Config(stackConfig)),
+		ec2Client:    ec2.New(sess, region),
+		iamClient:    iam.New(sess),
+		snsClient:    sns.New(sess, region),
+		lambdaClient: lambda.New(sess, region),
+		logsClient:   cloudwatchlogs.New(sess, region),
+		cwClient:     cloudwatch.New(sess, region),
+		eventsClient: cloudwatchevents.New(sess, region),
+		dynamoClient: dynamodb.New(sess, region),
+	}, nil
+}
+
+// Apply creates the resources of the stack that don't exist yet, updates those
+// whose inputs changed and removes those the stack no longer has.
+func (client *NativeClient) Apply() error {
+	if err := client.lock("apply"); err != nil {
+		return err
+	}
+	defer client.unlock()
+	if err := client.loadState(); err != nil {
+		return err
+	}
+
+	resources, err := client.resources()
+	if err != nil {
+		return err
+	}
+	wanted := map[string]bool{}
+	changes := 0
+	for _, resource := range resources {
+		wanted[resource.address] = true
+		current := client.stateOf(resource.address)
+		if current == nil {
+			fmt.Printf("  + %s\n", resource.address)
+			changes++
+		} else if current.Hash != inputsHash(resource.inputs()) {
+			fmt.Printf("  ~ %s\n", resource.address)
+			changes++
+		}
+	}
+	for _, current := range client.state.Resources {
+		if !wanted[current.Address] {
+			fmt.Printf("  - %s\n", current.Address)
+			changes++
+		}
+	}
+	if changes == 0 {
+		log.Info("No changes, stack is up to date")
+		return nil
+	}
+	log.Infof("Applying %d changes", changes)
+
+	for _, resource := range resources {
+		// inputs are evaluated again as ids of resources they refer to may have changed
+		hash := inputsHash(resource.inputs())
+		current := client.stateOf(resource.address)
+		if current != nil && current.Hash == hash {
+			continue
+		}
+		id := ""
+		if current != nil {
+			id = current.ID
+		}
+		id, err = resource.apply(id)
+		if err != nil {
+			// keep track of resources that were created before failing
+			if id != "" {
+				client.setState(resource.address, id, "")
+			}
+			return fmt.Errorf("Failed to apply %s: %v", resource.address, err)
+		}
+		log.Infof("Applied %s (%s)", resource.address, id)
+		err = client.setState(resource.address, id, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(client.state.Resources) - 1; i >= 0; i-- {
+		current := client.state.Resources[i]
+		if wanted[current.Address] {
+			continue
+		}
+		err = client.destroyResource(current)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Destroy removes every resource of the stack in reverse order of creation and
+// then the state document.
+func (client *NativeClient) Destroy() error {
+	if err := client.lock("destroy"); err != nil {
+		return err
+	}
+	defer client.unlock()
+	if err := client.loadState(); err != nil {
+		return err
+	}
+
+	for i := len(client.state.Resources) - 1; i >= 0; i-- {
+		err := client.destroyResource(client.state.Resources[i])
+		if err != nil {
+			return err
+		}
+	}
+	_, err := client.s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &client.config.Name,
+		Key:    aws.String(nativeStateKey),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to delete native state from bucket %s: %v", client.config.Name, err)
+	}
+	return nil
+}
+
+func (client *NativeClient) Cleanup() error {
+	return client.config.TempDir.Cleanup()
+}
+
+func (client *NativeClient) destroyResource(current nativeResourceState) error {
+	resourceType := strings.SplitN(current.Address, ".", 2)[0]
+	destroy, ok := nativeDestroyers[resourceType]
+	if !ok {
+		return fmt.Errorf("Don't know how to remove %s", current.Address)
+	}
+	err := destroy(client, current.ID)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("Failed to remove %s (%s): %v", current.Address, current.ID, err)
+	}
+	log.Infof("Removed %s (%s)", current.Address, current.ID)
+	return client.removeState(current.Address)
+}
+
+// id returns the id of a resource created earlier in the run or a previous one
+func (client *NativeClient) id(address string) string {
+	return client.ids[address]
+}
+
+func (client *NativeClient) stateOf(address string) *nativeResourceState {
+	for i := range client.state.Resources {
+		if client.state.Resources[i].Address == address {
+			return &client.state.Resources[i]
+		}
+	}
+	return nil
+}
+
+func (client *NativeClient) setState(address, id, hash string) error {
+	client.ids[address] = id
+	if current := client.stateOf(address); current != nil {
+		current.ID = id
+		current.Hash = hash
+	} else {
+		client.state.Resources = append(client.state.Resources, nativeResourceState{Address: address, ID: id, Hash: hash})
+	}
+	return client.saveState()
+}
+
+func (client *NativeClient) removeState(address string) error {
+	delete(client.ids, address)
+	for i := range client.state.Resources {
+		if client.state.Resources[i].Address == address {
+			client.state.Resources = append(client.state.Resources[:i], client.state.Resources[i+1:]...)
+			break
+		}
+	}
+	return client.saveState()
+}
+
+// loadState reads the state document, migrating the terraform state of the
+// stack the first time the native engine is used for it.
+func (client *NativeClient) loadState() error {
+	output, err := client.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &client.config.Name,
+		Key:    aws.String(nativeStateKey),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return client.migrateTerraformState()
+		}
+		return fmt.Errorf("Failed to read native state from bucket %s: %v", client.config.Name, err)
+	}
+	defer output.Body.Close()
+
+	state := &nativeState{}
+	err = json.NewDecoder(output.Body).Decode(state)
+	if err != nil {
+		return fmt.Errorf("Failed to parse native state: %v", err)
+	}
+	if state.Version > nativeStateVersion {
+		return fmt.Errorf("Native state of stack %s was written by a newer version of copperheados-stack", client.config.Name)
+	}
+	client.state = state
+	for _, resource := range state.Resources {
+		client.ids[resource.Address] = resource.ID
+	}
+	return nil
+}
+
+func (client *NativeClient) saveState() error {
+	client.state.Version = nativeStateVersion
+	body, err := json.MarshalIndent(client.state, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = client.s3Client.PutObject(&s3.PutObjectInput{
+		Bucket: &client.config.Name,
+		Key:    aws.String(nativeStateKey),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save native state to bucket %s: %v", client.config.Name, err)
+	}
+	return nil
+}
+
+// terraformState is the part of a terraform 0.11 state file needed to find the
+// resources it created.
+type terraformState struct {
+	Modules []struct {
+		Resources map[string]struct {
+			Type    string `json:"type"`
+			Primary struct {
+				ID         string            `json:"id"`
+				Attributes map[string]string `json:"attributes"`
+			} `json:"primary"`
+		} `json:"resources"`
+	} `json:"modules"`
+}
+
+// migrateTerraformState takes over the resources in the terraform state of the
+// stack. They are recorded without input hashes, so the first apply brings
+// every one of them in line with the native engine. The terraform state itself
+// is left in place as a backup.
+func (client *NativeClient) migrateTerraformState() error {
+	client.state = &nativeState{Version: nativeStateVersion, Resources: []nativeResourceState{}}
+
+	output, err := client.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &client.config.Name,
+		Key:    aws.String(terraformStateKey),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil
+		}
+		return fmt.Errorf("Failed to read terraform state from bucket %s: %v", client.config.Name, err)
+	}
+	defer output.Body.Close()
+	body, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return err
+	}
+	tfState := terraformState{}
+	err = json.Unmarshal(body, &tfState)
+	if err != nil {
+		return fmt.Errorf("Failed to parse terraform state: %v", err)
+	}
+
+	imported := map[string]nativeResourceState{}
+	for _, module := range tfState.Modules {
+		for address, resource := range module.Resources {
+			if strings.HasPrefix(address, "data.") {
+				continue
+			}
+			importID, ok := nativeImporters[resource.Type]
+			if !ok {
+				return fmt.Errorf("Terraform state of stack %s has %s, which is not supported by the native engine", client.config.Name, address)
+			}
+			// terraform leaves out the index of resources with a count of 1
+			if nativeCounted[address] {
+				address += ".0"
+			}
+			imported[address] = nativeResourceState{
+				Address: address,
+				ID:      importID(resource.Primary.ID, resource.Primary.Attributes),
+			}
+		}
+	}
+	if len(imported) == 0 {
+		return nil
+	}
+
+	// keep the order resources are created in so they are removed in reverse
+	resources, err := client.resources()
+	if err != nil {
+		return err
+	}
+	for _, resource := range resources {
+		if current, ok := imported[resource.address]; ok {
+			client.state.Resources = append(client.state.Resources, current)
+			delete(imported, resource.address)
+		}
+	}
+	leftover := []string{}
+	for address := range imported {
+		leftover = append(leftover, address)
+	}
+	sort.Strings(leftover)
+	for _, address := range leftover {
+		client.state.Resources = append(client.state.Resources, imported[address])
+	}
+	for _, resource := range client.state.Resources {
+		client.ids[resource.Address] = resource.ID
+	}
+
+	log.Infof("Migrated %d resources from the terraform state of stack %s, which is kept in bucket %s as a backup", len(client.state.Resources), client.config.Name, client.config.Name)
+	return client.saveState()
+}
+
+func nativeLockID(name string) string {
+	return name + "/" + nativeStateKey
+}
+
+// lock takes the native state lock in the terraform lock table, after making
+// sure terraform isn't running against the stack either.
+func (client *NativeClient) lock(operation string) error {
+	err := checkStateUnlocked(client.stackConfig)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	info := fmt.Sprintf("%s by %s@%s at %s", operation, os.Getenv("USER"), hostname, time.Now().UTC().Format(time.RFC3339))
+	_, err = client.dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(lockTableName(client.config.Name)),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(nativeLockID(client.config.Name))},
+			"Info":   {S: aws.String(info)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(LockID)"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return fmt.Errorf("State of stack %s is locked, wait for the running operation to finish", client.config.Name)
+		}
+		return fmt.Errorf("Failed to lock native state: %v", err)
+	}
+	return nil
+}
+
+func (client *NativeClient) unlock() {
+	_, err := client.dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(lockTableName(client.config.Name)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(nativeLockID(client.config.Name))},
+		},
+	})
+	if err != nil {
+		log.Warnf("Failed to release native state lock, remove item %s from table %s: %v", nativeLockID(client.config.Name), lockTableName(client.config.Name), err)
+	}
+}
+
+// nativeStateExists reports whether a stack is managed by the native engine.
+func nativeStateExists(config StackConfig) (bool, error) {
+	s3Client, err := stateS3Client(config)
+	if err != nil {
+		return false, err
+	}
+	_, err = s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &config.Name,
+		Key:    aws.String(nativeStateKey),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return false, nil
+		}
+		return false, fmt.Errorf("Failed to check for native state in bucket %s: %v", config.Name, err)
+	}
+	return true, nil
+}
+
+func inputsHash(inputs interface{}) string {
+	body, err := json.Marshal(inputs)
+	if err != nil {
+		// inputs are plain values, this can't happen
+		panic(err)
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// isNotFound reports whether err is an AWS error about a resource that doesn't
+// exist. Services don't agree on a single error code for that.
+func isNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	code := aerr.Code()
+	return strings.Contains(code, "NotFound") || strings.HasPrefix(code, "NoSuch")
+}
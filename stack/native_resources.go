@@ -0,0 +1,976 @@
+package stack
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatchevents"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/dan-v/copperheados-stack/checker"
+	log "github.com/sirupsen/logrus"
+)
+
+// the policies given to every role of a stack, same as the terraform template
+const (
+	allowAllPolicy = `{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": "*", "Resource": "*"}]}`
+	assumeRoleFmt  = `{"Version": "2012-10-17", "Statement": [{"Action": "sts:AssumeRole", "Principal": {"Service": "%s"}, "Effect": "Allow", "Sid": ""}]}`
+)
+
+// new roles take a while to become usable by lambda
+const (
+	lambdaRoleRetries  = 10
+	lambdaRoleInterval = 6 * time.Second
+)
+
+// resources are counted in the terraform template
+var nativeCounted = map[string]bool{
+	"aws_subnet.chos_public":                  true,
+	"aws_route_table_association.chos_public": true,
+	"aws_sns_topic_subscription.chos_sms":     true,
+}
+
+// nativeImporters convert the ids terraform uses for a resource type to those
+// of the native engine, which sometimes need more to find the resource again.
+var nativeImporters = map[string]func(id string, attributes map[string]string) string{
+	"aws_vpc":                     terraformID,
+	"aws_internet_gateway":        terraformID,
+	"aws_route_table":             terraformID,
+	"aws_subnet":                  terraformID,
+	"aws_route_table_association": terraformID,
+	"aws_security_group":          terraformID,
+	"aws_iam_role":                terraformID,
+	"aws_iam_role_policy":         terraformID,
+	"aws_iam_instance_profile":    terraformID,
+	"aws_s3_bucket":               terraformID,
+	"aws_s3_bucket_object": func(id string, attributes map[string]string) string {
+		return attributes["bucket"] + "/" + attributes["key"]
+	},
+	"aws_sns_topic":              terraformID,
+	"aws_sns_topic_subscription": terraformID,
+	"aws_cloudwatch_log_group":   terraformID,
+	"aws_lambda_function":        terraformID,
+	"aws_lambda_permission": func(id string, attributes map[string]string) string {
+		return attributes["function_name"] + "/" + attributes["statement_id"]
+	},
+	"aws_cloudwatch_dashboard":    terraformID,
+	"aws_cloudwatch_metric_alarm": terraformID,
+	"aws_cloudwatch_event_rule":   terraformID,
+	"aws_cloudwatch_event_target": func(id string, attributes map[string]string) string {
+		return attributes["rule"] + "/" + attributes["target_id"]
+	},
+}
+
+func terraformID(id string, attributes map[string]string) string {
+	return id
+}
+
+var nativeDestroyers = map[string]func(client *NativeClient, id string) error{
+	"aws_vpc": func(client *NativeClient, id string) error {
+		_, err := client.ec2Client.DeleteVpc(&ec2.DeleteVpcInput{VpcId: &id})
+		return err
+	},
+	"aws_internet_gateway": func(client *NativeClient, id string) error {
+		if err := client.detachInternetGateway(id, ""); err != nil {
+			return err
+		}
+		_, err := client.ec2Client.DeleteInternetGateway(&ec2.DeleteInternetGatewayInput{InternetGatewayId: &id})
+		return err
+	},
+	"aws_route_table": func(client *NativeClient, id string) error {
+		_, err := client.ec2Client.DeleteRouteTable(&ec2.DeleteRouteTableInput{RouteTableId: &id})
+		return err
+	},
+	"aws_subnet": func(client *NativeClient, id string) error {
+		_, err := client.ec2Client.DeleteSubnet(&ec2.DeleteSubnetInput{SubnetId: &id})
+		return err
+	},
+	"aws_route_table_association": func(client *NativeClient, id string) error {
+		_, err := client.ec2Client.DisassociateRouteTable(&ec2.DisassociateRouteTableInput{AssociationId: &id})
+		return err
+	},
+	"aws_security_group": func(client *NativeClient, id string) error {
+		_, err := client.ec2Client.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{GroupId: &id})
+		return err
+	},
+	"aws_iam_role": func(client *NativeClient, id string) error {
+		_, err := client.iamClient.DeleteRole(&iam.DeleteRoleInput{RoleName: &id})
+		return err
+	},
+	"aws_iam_role_policy": func(client *NativeClient, id string) error {
+		parts := strings.SplitN(id, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Unexpected role policy id %s", id)
+		}
+		_, err := client.iamClient.DeleteRolePolicy(&iam.DeleteRolePolicyInput{RoleName: &parts[0], PolicyName: &parts[1]})
+		return err
+	},
+	"aws_iam_instance_profile": func(client *NativeClient, id string) error {
+		output, err := client.iamClient.GetInstanceProfile(&iam.GetInstanceProfileInput{InstanceProfileName: &id})
+		if err != nil {
+			return err
+		}
+		for _, role := range output.InstanceProfile.Roles {
+			_, err = client.iamClient.RemoveRoleFromInstanceProfile(&iam.RemoveRoleFromInstanceProfileInput{
+				InstanceProfileName: &id,
+				RoleName:            role.RoleName,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		_, err = client.iamClient.DeleteInstanceProfile(&iam.DeleteInstanceProfileInput{InstanceProfileName: &id})
+		return err
+	},
+	"aws_s3_bucket": func(client *NativeClient, id string) error {
+		_, err := client.s3Client.DeleteBucket(&s3.DeleteBucketInput{Bucket: &id})
+		return err
+	},
+	"aws_s3_bucket_object": func(client *NativeClient, id string) error {
+		parts := strings.SplitN(id, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Unexpected bucket object id %s", id)
+		}
+		_, err := client.s3Client.DeleteObject(&s3.DeleteObjectInput{Bucket: &parts[0], Key: &parts[1]})
+		return err
+	},
+	"aws_sns_topic": func(client *NativeClient, id string) error {
+		_, err := client.snsClient.DeleteTopic(&sns.DeleteTopicInput{TopicArn: &id})
+		return err
+	},
+	"aws_sns_topic_subscription": func(client *NativeClient, id string) error {
+		_, err := client.snsClient.Unsubscribe(&sns.UnsubscribeInput{SubscriptionArn: &id})
+		return err
+	},
+	"aws_cloudwatch_log_group": func(client *NativeClient, id string) error {
+		_, err := client.logsClient.DeleteLogGroup(&cloudwatchlogs.DeleteLogGroupInput{LogGroupName: &id})
+		return err
+	},
+	"aws_lambda_function": func(client *NativeClient, id string) error {
+		_, err := client.lambdaClient.DeleteFunction(&lambda.DeleteFunctionInput{FunctionName: &id})
+		return err
+	},
+	"aws_lambda_permission": func(client *NativeClient, id string) error {
+		parts := strings.SplitN(id, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Unexpected lambda permission id %s", id)
+		}
+		_, err := client.lambdaClient.RemovePermission(&lambda.RemovePermissionInput{FunctionName: &parts[0], StatementId: &parts[1]})
+		return err
+	},
+	"aws_cloudwatch_dashboard": func(client *NativeClient, id string) error {
+		_, err := client.cwClient.DeleteDashboards(&cloudwatch.DeleteDashboardsInput{DashboardNames: []*string{&id}})
+		return err
+	},
+	"aws_cloudwatch_metric_alarm": func(client *NativeClient, id string) error {
+		_, err := client.cwClient.DeleteAlarms(&cloudwatch.DeleteAlarmsInput{AlarmNames: []*string{&id}})
+		return err
+	},
+	"aws_cloudwatch_event_rule": func(client *NativeClient, id string) error {
+		_, err := client.eventsClient.DeleteRule(&cloudwatchevents.DeleteRuleInput{Name: &id})
+		return err
+	},
+	"aws_cloudwatch_event_target": func(client *NativeClient, id string) error {
+		parts := strings.SplitN(id, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Unexpected event target id %s", id)
+		}
+		_, err := client.eventsClient.RemoveTargets(&cloudwatchevents.RemoveTargetsInput{Rule: &parts[0], Ids: []*string{&parts[1]}})
+		return err
+	},
+}
+
+// resources returns the resources of the stack in the order they have to be
+// created in, mirroring the terraform template.
+func (client *NativeClient) resources() ([]nativeResource, error) {
+	config := client.config
+	zones, err := client.availabilityZones()
+	if err != nil {
+		return nil, err
+	}
+
+	resources := []nativeResource{
+		client.vpc(),
+		client.internetGateway(),
+		client.routeTable(),
+	}
+	for i, zone := range zones {
+		resources = append(resources, client.subnet(i, zone), client.routeTableAssociation(i))
+	}
+	resources = append(resources,
+		client.securityGroup(),
+		client.role("aws_iam_role.chos_ec2_role", config.Name+"-ec2", "ec2.amazonaws.com"),
+		client.instanceProfile(),
+		client.rolePolicy("aws_iam_role_policy.chos_ec2_policy", "aws_iam_instance_profile.chos_ec2_role", config.Name+"-ec2-policy"),
+		client.role("aws_iam_role.chos_lambda_role", config.Name+"-lambda", "lambda.amazonaws.com"),
+		client.rolePolicy("aws_iam_role_policy.chos_lambda_policy", "aws_iam_role.chos_lambda_role", config.Name+"-lambda-policy"),
+		client.role("aws_iam_role.chos_spot_fleet_role", config.Name+"-spot-fleet-role", "spotfleet.amazonaws.com"),
+		client.rolePolicy("aws_iam_role_policy.chos_spot_fleet_policy", "aws_iam_role.chos_spot_fleet_role", config.Name+"-spot-fleet-policy"),
+		client.bucket("aws_s3_bucket.chos_s3_keys", config.Name+"-keys", s3.BucketCannedACLPrivate, false),
+		client.bucket("aws_s3_bucket.chos_s3_logs", config.Name+"-logs", s3.BucketCannedACLPrivate, false),
+		client.bucket("aws_s3_bucket.chos_s3_release", config.Name+"-release", s3.BucketCannedACLPublicRead, true),
+		client.bucket("aws_s3_bucket.chos_s3_script", config.Name+"-script", s3.BucketCannedACLPrivate, false),
+		client.scriptObject(),
+		client.topic(),
+		client.logGroup(),
+		client.function("aws_lambda_function.chos_lambda_build", config.Name+"-build", LambdaBuildBootstrapFilename, "provided", config.TempDir.Path(LambdaBuildZipFilename), config.CheckerBinaryBytes, true),
+		client.function("aws_lambda_function.chos_lambda_notify", config.Name+"-notify", "lambda_notify_function.lambda_handler", lambda.RuntimePython36, config.TempDir.Path(LambdaNotifyZipFilename), config.LambdaNotifyFunctionBytes, false),
+	)
+	for i, number := range config.NotifySMS {
+		resources = append(resources, client.subscription(fmt.Sprintf("aws_sns_topic_subscription.chos_sms.%d", i), "sms", func() string { return number }))
+	}
+	resources = append(resources,
+		client.subscription("aws_sns_topic_subscription.chos_notify", "lambda", func() string {
+			return client.arn("lambda", "function:"+client.id("aws_lambda_function.chos_lambda_notify"))
+		}),
+		client.permission("aws_lambda_permission.allow_sns_to_call_notify", "AllowExecutionFromSNS", "aws_lambda_function.chos_lambda_notify", "sns.amazonaws.com", func() string {
+			return client.id("aws_sns_topic.chos")
+		}),
+		client.dashboard(),
+	)
+	if config.NoBuildAlarmDays > 0 {
+		resources = append(resources, client.alarm("aws_cloudwatch_metric_alarm.chos_no_successful_build", &cloudwatch.PutMetricAlarmInput{
+			AlarmName:          aws.String(config.Name + "-no-successful-build"),
+			AlarmDescription:   aws.String(fmt.Sprintf("No successful CopperheadOS build of %s in %d days", config.Device, config.NoBuildAlarmDays)),
+			Namespace:          aws.String("CopperheadOS"),
+			MetricName:         aws.String("BuildSuccess"),
+			Statistic:          aws.String(cloudwatch.StatisticSum),
+			Period:             aws.Int64(86400),
+			EvaluationPeriods:  aws.Int64(int64(config.NoBuildAlarmDays)),
+			ComparisonOperator: aws.String(cloudwatch.ComparisonOperatorLessThanThreshold),
+			Threshold:          aws.Float64(1),
+			TreatMissingData:   aws.String("breaching"),
+			Dimensions: []*cloudwatch.Dimension{
+				{Name: aws.String("Stack"), Value: aws.String(config.Name)},
+				{Name: aws.String("Device"), Value: aws.String(config.Device)},
+			},
+		}))
+	}
+	resources = append(resources, client.alarm("aws_cloudwatch_metric_alarm.chos_lambda_errors", &cloudwatch.PutMetricAlarmInput{
+		AlarmName:          aws.String(config.Name + "-build-lambda-errors"),
+		AlarmDescription:   aws.String(fmt.Sprintf("CopperheadOS build checker Lambda %s-build failed", config.Name)),
+		Namespace:          aws.String("AWS/Lambda"),
+		MetricName:         aws.String("Errors"),
+		Statistic:          aws.String(cloudwatch.StatisticSum),
+		Period:             aws.Int64(900),
+		EvaluationPeriods:  aws.Int64(1),
+		ComparisonOperator: aws.String(cloudwatch.ComparisonOperatorGreaterThanThreshold),
+		Threshold:          aws.Float64(0),
+		TreatMissingData:   aws.String("notBreaching"),
+		Dimensions: []*cloudwatch.Dimension{
+			{Name: aws.String("FunctionName"), Value: aws.String(config.Name + "-build")},
+		},
+	}))
+
+	resources = append(resources, client.schedule("every_day", "check_build_every_day", "allow_cloudwatch_to_call_check_foo", "AllowExecutionFromCloudWatch",
+		config.Name+"-daily-check", "CopperheadOS build check", config.Schedule, config.Name+"-build", "")...)
+	resources = append(resources, client.schedule("fallback_check", "fallback_check", "allow_cloudwatch_fallback_check", "AllowFallbackExecutionFromCloudWatch",
+		config.Name+"-fallback-check", "CopperheadOS check for unfulfilled spot requests", "rate(15 minutes)", config.Name+"-fallback", `{"action": "fallback"}`)...)
+	if config.BuildWindow != nil {
+		resources = append(resources, client.schedule("deferred_check", "deferred_check", "allow_cloudwatch_deferred_check", "AllowDeferredExecutionFromCloudWatch",
+			config.Name+"-deferred-check", "CopperheadOS start builds deferred until the build window", "rate(15 minutes)", config.Name+"-deferred", `{"action": "deferred"}`)...)
+	}
+	return resources, nil
+}
+
+func (client *NativeClient) availabilityZones() ([]string, error) {
+	output, err := client.ec2Client.DescribeAvailabilityZones(&ec2.DescribeAvailabilityZonesInput{
+		Filters: []*ec2.Filter{{Name: aws.String("state"), Values: []*string{aws.String("available")}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list availability zones of %s: %v", client.config.Region, err)
+	}
+	zones := []string{}
+	for _, zone := range output.AvailabilityZones {
+		zones = append(zones, aws.StringValue(zone.ZoneName))
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+func (client *NativeClient) tags() map[string]string {
+	return map[string]string{
+		StackTagKey:   client.config.Name,
+		DeviceTagKey:  client.config.Device,
+		VersionTagKey: client.config.Version,
+	}
+}
+
+func (client *NativeClient) tagEC2(id, name string) error {
+	tags := []*ec2.Tag{{Key: aws.String("Name"), Value: aws.String(name)}}
+	for key, value := range client.tags() {
+		tags = append(tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	_, err := client.ec2Client.CreateTags(&ec2.CreateTagsInput{Resources: []*string{&id}, Tags: tags})
+	return err
+}
+
+func (client *NativeClient) vpc() nativeResource {
+	return nativeResource{
+		address: "aws_vpc.chos",
+		inputs: func() interface{} {
+			return []interface{}{"10.0.0.0/16", client.tags()}
+		},
+		apply: func(id string) (string, error) {
+			if id == "" {
+				output, err := client.ec2Client.CreateVpc(&ec2.CreateVpcInput{CidrBlock: aws.String("10.0.0.0/16")})
+				if err != nil {
+					return "", err
+				}
+				id = aws.StringValue(output.Vpc.VpcId)
+				err = client.ec2Client.WaitUntilVpcAvailable(&ec2.DescribeVpcsInput{VpcIds: []*string{&id}})
+				if err != nil {
+					return id, err
+				}
+			}
+			_, err := client.ec2Client.ModifyVpcAttribute(&ec2.ModifyVpcAttributeInput{
+				VpcId:              &id,
+				EnableDnsHostnames: &ec2.AttributeBooleanValue{Value: aws.Bool(true)},
+			})
+			if err != nil {
+				return id, err
+			}
+			return id, client.tagEC2(id, client.config.Name)
+		},
+	}
+}
+
+func (client *NativeClient) internetGateway() nativeResource {
+	return nativeResource{
+		address: "aws_internet_gateway.chos",
+		inputs: func() interface{} {
+			return []interface{}{client.id("aws_vpc.chos"), client.tags()}
+		},
+		apply: func(id string) (string, error) {
+			vpcID := client.id("aws_vpc.chos")
+			if id == "" {
+				output, err := client.ec2Client.CreateInternetGateway(&ec2.CreateInternetGatewayInput{})
+				if err != nil {
+					return "", err
+				}
+				id = aws.StringValue(output.InternetGateway.InternetGatewayId)
+			} else if err := client.detachInternetGateway(id, vpcID); err != nil {
+				return id, err
+			}
+			_, err := client.ec2Client.AttachInternetGateway(&ec2.AttachInternetGatewayInput{InternetGatewayId: &id, VpcId: &vpcID})
+			if err != nil && !strings.HasPrefix(errorCode(err), "Resource.AlreadyAssociated") {
+				return id, err
+			}
+			return id, client.tagEC2(id, client.config.Name)
+		},
+	}
+}
+
+// detachInternetGateway detaches a gateway from every vpc other than keep.
+func (client *NativeClient) detachInternetGateway(id, keep string) error {
+	output, err := client.ec2Client.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{InternetGatewayIds: []*string{&id}})
+	if err != nil {
+		return err
+	}
+	for _, gateway := range output.InternetGateways {
+		for _, attachment := range gateway.Attachments {
+			if aws.StringValue(attachment.VpcId) == keep {
+				continue
+			}
+			_, err = client.ec2Client.DetachInternetGateway(&ec2.DetachInternetGatewayInput{InternetGatewayId: &id, VpcId: attachment.VpcId})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (client *NativeClient) routeTable() nativeResource {
+	return nativeResource{
+		address: "aws_route_table.chos_public",
+		inputs: func() interface{} {
+			return []interface{}{client.id("aws_vpc.chos"), client.id("aws_internet_gateway.chos"), client.tags()}
+		},
+		apply: func(id string) (string, error) {
+			if id == "" {
+				output, err := client.ec2Client.CreateRouteTable(&ec2.CreateRouteTableInput{VpcId: aws.String(client.id("aws_vpc.chos"))})
+				if err != nil {
+					return "", err
+				}
+				id = aws.StringValue(output.RouteTable.RouteTableId)
+			}
+			_, err := client.ec2Client.CreateRoute(&ec2.CreateRouteInput{
+				RouteTableId:         &id,
+				DestinationCidrBlock: aws.String("0.0.0.0/0"),
+				GatewayId:            aws.String(client.id("aws_internet_gateway.chos")),
+			})
+			if err != nil && errorCode(err) == "RouteAlreadyExists" {
+				_, err = client.ec2Client.ReplaceRoute(&ec2.ReplaceRouteInput{
+					RouteTableId:         &id,
+					DestinationCidrBlock: aws.String("0.0.0.0/0"),
+					GatewayId:            aws.String(client.id("aws_internet_gateway.chos")),
+				})
+			}
+			if err != nil {
+				return id, err
+			}
+			return id, client.tagEC2(id, client.config.Name+"-public")
+		},
+	}
+}
+
+func (client *NativeClient) subnet(index int, zone string) nativeResource {
+	cidr := fmt.Sprintf("10.0.%d.0/24", index)
+	return nativeResource{
+		address: fmt.Sprintf("aws_subnet.chos_public.%d", index),
+		inputs: func() interface{} {
+			return []interface{}{client.id("aws_vpc.chos"), cidr, zone, client.tags()}
+		},
+		apply: func(id string) (string, error) {
+			if id == "" {
+				output, err := client.ec2Client.CreateSubnet(&ec2.CreateSubnetInput{
+					VpcId:            aws.String(client.id("aws_vpc.chos")),
+					CidrBlock:        &cidr,
+					AvailabilityZone: &zone,
+				})
+				if err != nil {
+					return "", err
+				}
+				id = aws.StringValue(output.Subnet.SubnetId)
+			}
+			_, err := client.ec2Client.ModifySubnetAttribute(&ec2.ModifySubnetAttributeInput{
+				SubnetId:            &id,
+				MapPublicIpOnLaunch: &ec2.AttributeBooleanValue{Value: aws.Bool(true)},
+			})
+			if err != nil {
+				return id, err
+			}
+			return id, client.tagEC2(id, client.config.Name+"-public-"+zone)
+		},
+	}
+}
+
+func (client *NativeClient) routeTableAssociation(index int) nativeResource {
+	subnet := fmt.Sprintf("aws_subnet.chos_public.%d", index)
+	return nativeResource{
+		address: fmt.Sprintf("aws_route_table_association.chos_public.%d", index),
+		inputs: func() interface{} {
+			return []interface{}{client.id(subnet), client.id("aws_route_table.chos_public")}
+		},
+		apply: func(id string) (string, error) {
+			if id != "" {
+				output, err := client.ec2Client.ReplaceRouteTableAssociation(&ec2.ReplaceRouteTableAssociationInput{
+					AssociationId: &id,
+					RouteTableId:  aws.String(client.id("aws_route_table.chos_public")),
+				})
+				if err != nil {
+					return id, err
+				}
+				return aws.StringValue(output.NewAssociationId), nil
+			}
+			output, err := client.ec2Client.AssociateRouteTable(&ec2.AssociateRouteTableInput{
+				SubnetId:     aws.String(client.id(subnet)),
+				RouteTableId: aws.String(client.id("aws_route_table.chos_public")),
+			})
+			if err != nil {
+				return "", err
+			}
+			return aws.StringValue(output.AssociationId), nil
+		},
+	}
+}
+
+func (client *NativeClient) securityGroup() nativeResource {
+	sshCIDR := ""
+	if client.config.SSHKey != "" {
+		sshCIDR = client.config.SSHCIDR
+	}
+	return nativeResource{
+		address: "aws_security_group.chos_build",
+		inputs: func() interface{} {
+			return []interface{}{client.id("aws_vpc.chos"), sshCIDR, client.tags()}
+		},
+		apply: func(id string) (string, error) {
+			if id == "" {
+				output, err := client.ec2Client.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+					GroupName:   aws.String(client.config.Name + "-build"),
+					Description: aws.String("CopperheadOS build instances"),
+					VpcId:       aws.String(client.id("aws_vpc.chos")),
+				})
+				if err != nil {
+					return "", err
+				}
+				id = aws.StringValue(output.GroupId)
+			}
+
+			// new groups allow all egress, only ingress is managed
+			output, err := client.ec2Client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{GroupIds: []*string{&id}})
+			if err != nil {
+				return id, err
+			}
+			for _, group := range output.SecurityGroups {
+				if len(group.IpPermissions) == 0 {
+					continue
+				}
+				_, err = client.ec2Client.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{GroupId: &id, IpPermissions: group.IpPermissions})
+				if err != nil {
+					return id, err
+				}
+			}
+			if sshCIDR != "" {
+				_, err = client.ec2Client.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+					GroupId: &id,
+					IpPermissions: []*ec2.IpPermission{{
+						IpProtocol: aws.String("tcp"),
+						FromPort:   aws.Int64(22),
+						ToPort:     aws.Int64(22),
+						IpRanges:   []*ec2.IpRange{{CidrIp: &sshCIDR}},
+					}},
+				})
+				if err != nil {
+					return id, err
+				}
+			}
+			return id, client.tagEC2(id, client.config.Name+"-build")
+		},
+	}
+}
+
+func (client *NativeClient) role(address, name, service string) nativeResource {
+	policy := fmt.Sprintf(assumeRoleFmt, service)
+	return nativeResource{
+		address: address,
+		inputs: func() interface{} {
+			return []interface{}{name, policy}
+		},
+		apply: func(id string) (string, error) {
+			_, err := client.iamClient.GetRole(&iam.GetRoleInput{RoleName: &name})
+			if isNotFound(err) {
+				_, err = client.iamClient.CreateRole(&iam.CreateRoleInput{RoleName: &name, AssumeRolePolicyDocument: &policy})
+				return name, err
+			}
+			if err != nil {
+				return id, err
+			}
+			_, err = client.iamClient.UpdateAssumeRolePolicy(&iam.UpdateAssumeRolePolicyInput{RoleName: &name, PolicyDocument: &policy})
+			return name, err
+		},
+	}
+}
+
+// rolePolicy gives the role (or role of the instance profile) at roleAddress
+// access to everything.
+func (client *NativeClient) rolePolicy(address, roleAddress, name string) nativeResource {
+	return nativeResource{
+		address: address,
+		inputs: func() interface{} {
+			return []interface{}{client.id(roleAddress), name, allowAllPolicy}
+		},
+		apply: func(id string) (string, error) {
+			role := client.id(roleAddress)
+			_, err := client.iamClient.PutRolePolicy(&iam.PutRolePolicyInput{
+				RoleName:       &role,
+				PolicyName:     &name,
+				PolicyDocument: aws.String(allowAllPolicy),
+			})
+			return role + ":" + name, err
+		},
+	}
+}
+
+func (client *NativeClient) instanceProfile() nativeResource {
+	name := client.config.Name + "-ec2"
+	return nativeResource{
+		address: "aws_iam_instance_profile.chos_ec2_role",
+		inputs: func() interface{} {
+			return []interface{}{name, client.id("aws_iam_role.chos_ec2_role")}
+		},
+		apply: func(id string) (string, error) {
+			role := client.id("aws_iam_role.chos_ec2_role")
+			output, err := client.iamClient.GetInstanceProfile(&iam.GetInstanceProfileInput{InstanceProfileName: &name})
+			if isNotFound(err) {
+				_, err = client.iamClient.CreateInstanceProfile(&iam.CreateInstanceProfileInput{InstanceProfileName: &name})
+				if err != nil {
+					return "", err
+				}
+			} else if err != nil {
+				return id, err
+			} else {
+				for _, existing := range output.InstanceProfile.Roles {
+					if aws.StringValue(existing.RoleName) == role {
+						return name, nil
+					}
+				}
+			}
+			_, err = client.iamClient.AddRoleToInstanceProfile(&iam.AddRoleToInstanceProfileInput{InstanceProfileName: &name, RoleName: &role})
+			return name, err
+		},
+	}
+}
+
+func (client *NativeClient) bucket(address, name, acl string, release bool) nativeResource {
+	retention := 0
+	if release {
+		retention = client.config.ReleaseRetention
+	}
+	return nativeResource{
+		address: address,
+		inputs: func() interface{} {
+			return []interface{}{name, acl, retention, client.config.Device, client.tags()}
+		},
+		apply: func(id string) (string, error) {
+			input := &s3.CreateBucketInput{Bucket: &name}
+			// see s3BucketSetup
+			if client.config.Region != "us-east-1" {
+				input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: &client.config.Region}
+			}
+			_, err := client.s3Client.CreateBucket(input)
+			if err != nil && errorCode(err) != s3.ErrCodeBucketAlreadyOwnedByYou {
+				return "", err
+			}
+			_, err = client.s3Client.PutBucketAcl(&s3.PutBucketAclInput{Bucket: &name, ACL: &acl})
+			if err != nil {
+				return name, err
+			}
+			if release {
+				rules := []*s3.LifecycleRule{}
+				for _, rule := range [][]string{{"target", "-target/"}, {"incremental", "-incremental"}, {"ota", "-ota"}} {
+					rules = append(rules, &s3.LifecycleRule{
+						ID:         aws.String(rule[0]),
+						Status:     aws.String(s3.ExpirationStatusEnabled),
+						Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String(client.config.Device + rule[1])},
+						Expiration: &s3.LifecycleExpiration{Days: aws.Int64(int64(retention))},
+					})
+				}
+				_, err = client.s3Client.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+					Bucket:                 &name,
+					LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+				})
+				if err != nil {
+					return name, err
+				}
+			}
+			tagSet := []*s3.Tag{}
+			for key, value := range client.tags() {
+				tagSet = append(tagSet, &s3.Tag{Key: aws.String(key), Value: aws.String(value)})
+			}
+			_, err = client.s3Client.PutBucketTagging(&s3.PutBucketTaggingInput{Bucket: &name, Tagging: &s3.Tagging{TagSet: tagSet}})
+			return name, err
+		},
+	}
+}
+
+func (client *NativeClient) scriptObject() nativeResource {
+	bucket := client.config.Name + "-script"
+	return nativeResource{
+		address: "aws_s3_bucket_object.chos_s3_script_file",
+		inputs: func() interface{} {
+			return []interface{}{bucket, ShellScriptFilename, sha256Hex(client.config.ShellScriptBytes)}
+		},
+		apply: func(id string) (string, error) {
+			_, err := client.s3Client.PutObject(&s3.PutObjectInput{
+				Bucket: &bucket,
+				Key:    aws.String(ShellScriptFilename),
+				Body:   bytes.NewReader(client.config.ShellScriptBytes),
+			})
+			return bucket + "/" + ShellScriptFilename, err
+		},
+	}
+}
+
+func (client *NativeClient) topic() nativeResource {
+	return nativeResource{
+		address: "aws_sns_topic.chos",
+		inputs: func() interface{} {
+			return []interface{}{client.config.Name}
+		},
+		apply: func(id string) (string, error) {
+			output, err := client.snsClient.CreateTopic(&sns.CreateTopicInput{Name: &client.config.Name})
+			if err != nil {
+				return id, err
+			}
+			return aws.StringValue(output.TopicArn), nil
+		},
+	}
+}
+
+func (client *NativeClient) logGroup() nativeResource {
+	name := buildLogGroup(client.config.Name)
+	return nativeResource{
+		address: "aws_cloudwatch_log_group.chos_builds",
+		inputs: func() interface{} {
+			return []interface{}{name, client.config.LogRetention, client.tags()}
+		},
+		apply: func(id string) (string, error) {
+			tags := aws.StringMap(client.tags())
+			_, err := client.logsClient.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{LogGroupName: &name, Tags: tags})
+			if err != nil && errorCode(err) != cloudwatchlogs.ErrCodeResourceAlreadyExistsException {
+				return "", err
+			}
+			if err != nil {
+				_, err = client.logsClient.TagLogGroup(&cloudwatchlogs.TagLogGroupInput{LogGroupName: &name, Tags: tags})
+				if err != nil {
+					return name, err
+				}
+			}
+			_, err = client.logsClient.PutRetentionPolicy(&cloudwatchlogs.PutRetentionPolicyInput{
+				LogGroupName:    &name,
+				RetentionInDays: aws.Int64(int64(client.config.LogRetention)),
+			})
+			return name, err
+		},
+	}
+}
+
+func (client *NativeClient) function(address, name, handler, runtime, zipFile string, source []byte, build bool) nativeResource {
+	environment := func() map[string]string {
+		if !build {
+			return nil
+		}
+		subnets := []string{}
+		for i := 0; client.id(fmt.Sprintf("aws_subnet.chos_public.%d", i)) != ""; i++ {
+			subnets = append(subnets, client.id(fmt.Sprintf("aws_subnet.chos_public.%d", i)))
+		}
+		return map[string]string{
+			checker.ConfigEnv:          client.config.CheckerConfig,
+			checker.SubnetIDsEnv:       strings.Join(subnets, ","),
+			checker.SecurityGroupIDEnv: client.id("aws_security_group.chos_build"),
+			checker.TopicARNEnv:        client.id("aws_sns_topic.chos"),
+		}
+	}
+	return nativeResource{
+		address: address,
+		inputs: func() interface{} {
+			return []interface{}{name, handler, runtime, sha256Hex(source), client.id("aws_iam_role.chos_lambda_role"), environment(), client.tags()}
+		},
+		apply: func(id string) (string, error) {
+			code, err := ioutil.ReadFile(zipFile)
+			if err != nil {
+				return id, err
+			}
+			role, err := client.iamClient.GetRole(&iam.GetRoleInput{RoleName: aws.String(client.id("aws_iam_role.chos_lambda_role"))})
+			if err != nil {
+				return id, err
+			}
+			var env *lambda.Environment
+			if variables := environment(); variables != nil {
+				env = &lambda.Environment{Variables: aws.StringMap(variables)}
+			}
+
+			existing, err := client.lambdaClient.GetFunction(&lambda.GetFunctionInput{FunctionName: &name})
+			if isNotFound(err) {
+				for i := 0; ; i++ {
+					_, err = client.lambdaClient.CreateFunction(&lambda.CreateFunctionInput{
+						FunctionName: &name,
+						Role:         role.Role.Arn,
+						Handler:      &handler,
+						Runtime:      &runtime,
+						Timeout:      aws.Int64(60),
+						Code:         &lambda.FunctionCode{ZipFile: code},
+						Environment:  env,
+						Tags:         aws.StringMap(client.tags()),
+					})
+					if err == nil || errorCode(err) != lambda.ErrCodeInvalidParameterValueException || i == lambdaRoleRetries {
+						return name, err
+					}
+					log.Infof("Waiting for role %s to become usable by %s", aws.StringValue(role.Role.RoleName), name)
+					time.Sleep(lambdaRoleInterval)
+				}
+			}
+			if err != nil {
+				return id, err
+			}
+
+			_, err = client.lambdaClient.UpdateFunctionCode(&lambda.UpdateFunctionCodeInput{FunctionName: &name, ZipFile: code})
+			if err != nil {
+				return name, err
+			}
+			if env == nil {
+				env = &lambda.Environment{Variables: map[string]*string{}}
+			}
+			_, err = client.lambdaClient.UpdateFunctionConfiguration(&lambda.UpdateFunctionConfigurationInput{
+				FunctionName: &name,
+				Role:         role.Role.Arn,
+				Handler:      &handler,
+				Runtime:      &runtime,
+				Timeout:      aws.Int64(60),
+				Environment:  env,
+			})
+			if err != nil {
+				return name, err
+			}
+			_, err = client.lambdaClient.TagResource(&lambda.TagResourceInput{
+				Resource: existing.Configuration.FunctionArn,
+				Tags:     aws.StringMap(client.tags()),
+			})
+			return name, err
+		},
+	}
+}
+
+// arn returns the arn of a resource of the stack, taking the partition and
+// account from the arn of the topic. It is empty until the topic exists.
+func (client *NativeClient) arn(service, resource string) string {
+	parts := strings.Split(client.id("aws_sns_topic.chos"), ":")
+	if len(parts) < 5 {
+		return ""
+	}
+	return fmt.Sprintf("arn:%s:%s:%s:%s:%s", parts[1], service, client.config.Region, parts[4], resource)
+}
+
+func (client *NativeClient) subscription(address, protocol string, endpoint func() string) nativeResource {
+	return nativeResource{
+		address: address,
+		inputs: func() interface{} {
+			return []interface{}{client.id("aws_sns_topic.chos"), protocol, endpoint()}
+		},
+		apply: func(id string) (string, error) {
+			if id != "" {
+				_, err := client.snsClient.Unsubscribe(&sns.UnsubscribeInput{SubscriptionArn: &id})
+				if err != nil && !isNotFound(err) {
+					return id, err
+				}
+			}
+			output, err := client.snsClient.Subscribe(&sns.SubscribeInput{
+				TopicArn: aws.String(client.id("aws_sns_topic.chos")),
+				Protocol: &protocol,
+				Endpoint: aws.String(endpoint()),
+			})
+			if err != nil {
+				return "", err
+			}
+			return aws.StringValue(output.SubscriptionArn), nil
+		},
+	}
+}
+
+// permission allows principal to invoke the lambda function at
+// functionAddress from sourceArn.
+func (client *NativeClient) permission(address, statementID, functionAddress, principal string, sourceArn func() string) nativeResource {
+	return nativeResource{
+		address: address,
+		inputs: func() interface{} {
+			return []interface{}{statementID, client.id(functionAddress), principal, sourceArn()}
+		},
+		apply: func(id string) (string, error) {
+			function := client.id(functionAddress)
+			_, err := client.lambdaClient.RemovePermission(&lambda.RemovePermissionInput{FunctionName: &function, StatementId: &statementID})
+			if err != nil && !isNotFound(err) {
+				return id, err
+			}
+			_, err = client.lambdaClient.AddPermission(&lambda.AddPermissionInput{
+				FunctionName: &function,
+				StatementId:  &statementID,
+				Action:       aws.String("lambda:InvokeFunction"),
+				Principal:    &principal,
+				SourceArn:    aws.String(sourceArn()),
+			})
+			if err != nil {
+				return "", err
+			}
+			return function + "/" + statementID, nil
+		},
+	}
+}
+
+func (client *NativeClient) dashboard() nativeResource {
+	return nativeResource{
+		address: "aws_cloudwatch_dashboard.chos",
+		inputs: func() interface{} {
+			return []interface{}{client.config.Name, client.config.DashboardBody}
+		},
+		apply: func(id string) (string, error) {
+			_, err := client.cwClient.PutDashboard(&cloudwatch.PutDashboardInput{
+				DashboardName: &client.config.Name,
+				DashboardBody: &client.config.DashboardBody,
+			})
+			return client.config.Name, err
+		},
+	}
+}
+
+func (client *NativeClient) alarm(address string, input *cloudwatch.PutMetricAlarmInput) nativeResource {
+	return nativeResource{
+		address: address,
+		inputs: func() interface{} {
+			return []interface{}{input.String(), client.id("aws_sns_topic.chos")}
+		},
+		apply: func(id string) (string, error) {
+			alarm := *input
+			alarm.AlarmActions = []*string{aws.String(client.id("aws_sns_topic.chos"))}
+			_, err := client.cwClient.PutMetricAlarm(&alarm)
+			return aws.StringValue(input.AlarmName), err
+		},
+	}
+}
+
+// schedule returns an event rule invoking the build lambda function, its
+// target and the permission for the rule to invoke the function.
+func (client *NativeClient) schedule(ruleName, targetName, permissionName, statementID, name, description, expression, targetID, input string) []nativeResource {
+	ruleAddress := "aws_cloudwatch_event_rule." + ruleName
+	rule := nativeResource{
+		address: ruleAddress,
+		inputs: func() interface{} {
+			return []interface{}{name, description, expression}
+		},
+		apply: func(id string) (string, error) {
+			_, err := client.eventsClient.PutRule(&cloudwatchevents.PutRuleInput{
+				Name:               &name,
+				Description:        &description,
+				ScheduleExpression: &expression,
+			})
+			return name, err
+		},
+	}
+	target := nativeResource{
+		address: "aws_cloudwatch_event_target." + targetName,
+		inputs: func() interface{} {
+			return []interface{}{client.id(ruleAddress), targetID, client.id("aws_lambda_function.chos_lambda_build"), input}
+		},
+		apply: func(id string) (string, error) {
+			eventTarget := &cloudwatchevents.Target{
+				Id:  &targetID,
+				Arn: aws.String(client.arn("lambda", "function:"+client.id("aws_lambda_function.chos_lambda_build"))),
+			}
+			if input != "" {
+				eventTarget.Input = &input
+			}
+			output, err := client.eventsClient.PutTargets(&cloudwatchevents.PutTargetsInput{
+				Rule:    aws.String(client.id(ruleAddress)),
+				Targets: []*cloudwatchevents.Target{eventTarget},
+			})
+			if err != nil {
+				return id, err
+			}
+			if aws.Int64Value(output.FailedEntryCount) > 0 {
+				return id, fmt.Errorf("%s", aws.StringValue(output.FailedEntries[0].ErrorMessage))
+			}
+			return client.id(ruleAddress) + "/" + targetID, nil
+		},
+	}
+	permission := client.permission("aws_lambda_permission."+permissionName, statementID, "aws_lambda_function.chos_lambda_build", "events.amazonaws.com", func() string {
+		return client.arn("events", "rule/"+client.id(ruleAddress))
+	})
+	return []nativeResource{rule, target, permission}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	log "github.com/sirupsen/logrus"
+)
+
+// WebhookTypes are the payload formats the notifier lambda can post.
+var WebhookTypes = []string{"json", "slack", "matrix"}
+
+// Webhook is a notification target of the notifier lambda. Webhooks are stored
+// as SecureString parameters under /<name>/webhooks/ since their URLs usually
+// embed a secret.
+type Webhook struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+func webhookParameter(name, id string) string {
+	return fmt.Sprintf("/%s/webhooks/%s", name, id)
+}
+
+// AWSNotifyAdd adds a webhook to a stack, replacing any webhook with the same id.
+func AWSNotifyAdd(config StackConfig, id string, webhook Webhook) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	ssmClient := ssm.New(sess, &aws.Config{Region: &config.Region})
+
+	value, err := json.Marshal(webhook)
+	if err != nil {
+		return err
+	}
+	_, err = ssmClient.PutParameter(&ssm.PutParameterInput{
+		Name:        aws.String(webhookParameter(config.Name, id)),
+		Description: aws.String(fmt.Sprintf("%s webhook for CopperheadOS stack %s", webhook.Type, config.Name)),
+		Type:        aws.String(ssm.ParameterTypeSecureString),
+		Value:       aws.String(string(value)),
+		Overwrite:   aws.Bool(true),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to store webhook %s: %v", id, err)
+	}
+	_, err = ssmClient.AddTagsToResource(&ssm.AddTagsToResourceInput{
+		ResourceType: aws.String(ssm.ResourceTypeForTaggingParameter),
+		ResourceId:   aws.String(webhookParameter(config.Name, id)),
+		Tags:         []*ssm.Tag{{Key: aws.String(StackTagKey), Value: aws.String(config.Name)}},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to tag webhook %s: %v", id, err)
+	}
+	log.Infof("Added %s webhook %s", webhook.Type, id)
+	return nil
+}
+
+// AWSNotifyRemove removes a webhook from a stack.
+func AWSNotifyRemove(config StackConfig, id string) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	ssmClient := ssm.New(sess, &aws.Config{Region: &config.Region})
+
+	_, err = ssmClient.DeleteParameter(&ssm.DeleteParameterInput{
+		Name: aws.String(webhookParameter(config.Name, id)),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to remove webhook %s: %v", id, err)
+	}
+	log.Infof("Removed webhook %s", id)
+	return nil
+}
+
+// deleteWebhooks removes all webhooks of a stack, which aren't terraform or
+// native engine resources and would otherwise outlive it.
+func deleteWebhooks(config StackConfig) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	ssmClient := ssm.New(sess, &aws.Config{Region: &config.Region})
+
+	names := []*string{}
+	err = ssmClient.GetParametersByPathPages(&ssm.GetParametersByPathInput{
+		Path:      aws.String(fmt.Sprintf("/%s/webhooks", config.Name)),
+		Recursive: aws.Bool(true),
+	}, func(page *ssm.GetParametersByPathOutput, lastPage bool) bool {
+		for _, parameter := range page.Parameters {
+			names = append(names, parameter.Name)
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to list webhooks: %v", err)
+	}
+	// DeleteParameters takes at most 10 names
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > 10 {
+			batch = batch[:10]
+		}
+		names = names[len(batch):]
+		_, err = ssmClient.DeleteParameters(&ssm.DeleteParametersInput{Names: batch})
+		if err != nil {
+			return fmt.Errorf("Failed to remove webhooks: %v", err)
+		}
+		log.Infof("Removed %d webhooks", len(batch))
+	}
+	return nil
+}
+
+// AWSNotifyTest has the notifier lambda post a test notification to all
+// webhooks of a stack, or only to the webhook with the given id.
+func AWSNotifyTest(config StackConfig, id string) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	lambdaClient := lambda.New(sess, &aws.Config{Region: &config.Region})
+
+	payload, err := json.Marshal(map[string]interface{}{"test": true, "webhook": id})
+	if err != nil {
+		return err
+	}
+	output, err := lambdaClient.Invoke(&lambda.InvokeInput{
+		FunctionName: aws.String(config.Name + "-notify"),
+		Payload:      payload,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to invoke notifier lambda %s-notify: %v", config.Name, err)
+	}
+	if output.FunctionError != nil {
+		return fmt.Errorf("Notifier lambda %s-notify failed: %s", config.Name, output.Payload)
+	}
+
+	results := map[string]string{}
+	err = json.Unmarshal(output.Payload, &results)
+	if err != nil {
+		return fmt.Errorf("Unexpected response from notifier lambda: %v", err)
+	}
+	if len(results) == 0 {
+		return fmt.Errorf("No webhooks configured for stack %s", config.Name)
+	}
+
+	ids := []string{}
+	for id := range results {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "WEBHOOK\tRESULT\n")
+	for _, id := range ids {
+		fmt.Fprintf(w, "%s\t%s\n", id, results[id])
+		if results[id] != "ok" {
+			failed++
+		}
+	}
+	w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d webhooks failed", failed, len(results))
+	}
+	return nil
+}
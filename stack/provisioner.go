@@ -0,0 +1,51 @@
+package stack
+
+import (
+	"fmt"
+	"os"
+)
+
+// Engines that can provision the AWS resources of a stack
+const (
+	EngineTerraform = "terraform"
+	EngineNative    = "native"
+)
+
+// Provisioner creates, updates and removes the AWS resources of a stack.
+type Provisioner interface {
+	Apply() error
+	Destroy() error
+	Cleanup() error
+}
+
+func newProvisioner(config StackConfig) (Provisioner, error) {
+	terraformConf, err := generateTerraformConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate config: %v", err)
+	}
+
+	nativeState, err := nativeStateExists(config)
+	if err != nil {
+		return nil, err
+	}
+
+	var provisioner Provisioner
+	switch config.Engine {
+	case EngineNative:
+		provisioner, err = NewNativeClient(terraformConf, config)
+	case EngineTerraform, "":
+		// switching back would have terraform create every resource again
+		if nativeState {
+			terraformConf.TempDir.Cleanup()
+			return nil, fmt.Errorf("Stack %s is managed by the native engine, pass --engine native", config.Name)
+		}
+		provisioner, err = NewTerraformClient(terraformConf, os.Stdout, os.Stdin)
+	default:
+		err = fmt.Errorf("Unknown engine %s", config.Engine)
+	}
+	if err != nil {
+		terraformConf.TempDir.Cleanup()
+		return nil, fmt.Errorf("Failed to create client: %v", err)
+	}
+	return provisioner, nil
+}
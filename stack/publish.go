@@ -0,0 +1,157 @@
+package stack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	log "github.com/sirupsen/logrus"
+)
+
+// AWSPublish uploads the release directory of a local build to the release
+// bucket of a stack. Release channel metadata is uploaded last so devices only
+// see the new release once everything it refers to is in place.
+func AWSPublish(config StackConfig, dir string) error {
+	releaseDir := filepath.Join(dir, "release")
+	bucket := config.Name + "-release"
+
+	files, metadata := []string{}, []string{}
+	err := filepath.Walk(releaseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		key, err := filepath.Rel(releaseDir, path)
+		if err != nil {
+			return err
+		}
+		key = filepath.ToSlash(key)
+		if strings.HasSuffix(key, "-stable") || strings.HasSuffix(key, "-stable-true-timestamp") {
+			metadata = append(metadata, key)
+		} else {
+			files = append(files, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to read release directory %s: %v", releaseDir, err)
+	}
+	if len(metadata) == 0 {
+		return fmt.Errorf("No release found in %s, run build-local first", releaseDir)
+	}
+
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	s3Client := s3.New(sess, s3Config(config))
+	uploader := s3manager.NewUploaderWithClient(s3Client)
+
+	for _, key := range append(files, metadata...) {
+		// like builds on aws, only publish a factory image if there is none yet
+		if strings.HasSuffix(key, "-factory-latest.tar.xz") {
+			exists, err := objectExists(s3Client, bucket, key)
+			if err != nil {
+				return err
+			}
+			if exists {
+				log.Infof("Skipping %s, bucket %s already has a factory image", key, bucket)
+				continue
+			}
+		}
+		err = uploadFile(uploader, bucket, key, filepath.Join(releaseDir, filepath.FromSlash(key)))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range metadata {
+		if strings.HasSuffix(key, "-stable") {
+			err = removeOldOTAs(s3Client, bucket, releaseDir, key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Infof("Published release to %s", config.ReleaseURL())
+	return nil
+}
+
+func uploadFile(uploader *s3manager.Uploader, bucket, key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	log.Infof("Uploading %s to bucket %s", key, bucket)
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket: &bucket,
+		Key:    &key,
+		Body:   file,
+		ACL:    aws.String(s3.ObjectCannedACLPublicRead),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to upload %s to bucket %s: %v", key, bucket, err)
+	}
+	return nil
+}
+
+func objectExists(s3Client *s3.S3, bucket, key string) (bool, error) {
+	output, err := s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  &bucket,
+		Prefix:  &key,
+		MaxKeys: aws.Int64(1),
+	})
+	if err != nil {
+		return false, fmt.Errorf("Failed to list bucket %s: %v", bucket, err)
+	}
+	return len(output.Contents) > 0 && aws.StringValue(output.Contents[0].Key) == key, nil
+}
+
+// removeOldOTAs deletes the full OTA updates of a device that were replaced by
+// the release its channel metadata now points to.
+func removeOldOTAs(s3Client *s3.S3, bucket, releaseDir, channel string) error {
+	content, err := ioutil.ReadFile(filepath.Join(releaseDir, channel))
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return fmt.Errorf("Unexpected release metadata in %s", channel)
+	}
+	device := strings.TrimSuffix(channel, "-stable")
+	current := fmt.Sprintf("%s-ota_update-%s.zip", device, fields[0])
+
+	var deleteErr error
+	err = s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: &bucket,
+		Prefix: aws.String(device + "-ota_update-"),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			if aws.StringValue(object.Key) == current {
+				continue
+			}
+			log.Infof("Removing old OTA update %s", aws.StringValue(object.Key))
+			_, deleteErr = s3Client.DeleteObject(&s3.DeleteObjectInput{Bucket: &bucket, Key: object.Key})
+			if deleteErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to list OTA updates in bucket %s: %v", bucket, err)
+	}
+	if deleteErr != nil {
+		return fmt.Errorf("Failed to remove old OTA update from bucket %s: %v", bucket, deleteErr)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package stack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dan-v/copperheados-stack/templates"
+	log "github.com/sirupsen/logrus"
+)
+
+// RenderConfigFilename is the summary of the stack config written by Render.
+const RenderConfigFilename = "config.json"
+
+// Render writes what a deploy of a stack is made from to dir without touching
+// AWS: the terraform config, the build script, the Lambda functions and their
+// zips, and a summary of the stack config. The output only depends on the
+// config and the version of copperheados-stack, so it can be kept in git and
+// diffed between versions.
+func Render(config StackConfig, dir string) error {
+	if config.AMI == "" {
+		ami, err := getAMI(config.Region)
+		if err != nil {
+			return err
+		}
+		config.AMI = ami
+	}
+
+	terraformConf, err := generateTerraformConfig(config)
+	if err != nil {
+		return fmt.Errorf("Failed to generate config: %v", err)
+	}
+	terraformConf.TempDir.Cleanup()
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create directory %s: %v", dir, err)
+	}
+	// refer to the other files relative to main.tf, so terraform can be run in dir
+	terraformConf.TempDir = &TempDir{path: dir}
+	terraformConf.ShellScriptFile = ShellScriptFilename
+	terraformConf.LambdaBuildZipFile = LambdaBuildZipFilename
+	terraformConf.LambdaNotifyZipFile = LambdaNotifyZipFilename
+	err = writeStackFiles(terraformConf)
+	if err != nil {
+		return fmt.Errorf("Failed to write stack files to %s: %v", dir, err)
+	}
+
+	terraformFile, err := renderTemplate(templates.TerraformTemplate, terraformConf)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "main.tf"), terraformFile, 0644)
+	if err != nil {
+		return err
+	}
+
+	summary, err := json.MarshalIndent(configSummary(config), "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, RenderConfigFilename), append(summary, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	log.Infof("Rendered stack %s to %s", config.Name, dir)
+	return nil
+}
+
+// configSummary is the stack config in a readable form, with keys sorted by
+// encoding/json.
+func configSummary(config StackConfig) map[string]interface{} {
+	buildWindow := ""
+	if config.BuildWindow != nil {
+		buildWindow = config.BuildWindow.String()
+	}
+	return map[string]interface{}{
+		"name":                   config.Name,
+		"region":                 config.Region,
+		"device":                 config.Device,
+		"version":                config.Version,
+		"engine":                 config.Engine,
+		"ami":                    config.AMI,
+		"instance_types":         config.InstanceTypes,
+		"spot_price":             config.SpotPrice,
+		"max_spot_price":         config.MaxSpotPrice,
+		"fallback_policy":        config.FallbackPolicy,
+		"fallback_after":         config.FallbackAfter.String(),
+		"volume_size_gb":         config.VolumeSize,
+		"volume_type":            config.VolumeType,
+		"max_build_duration":     config.MaxBuildDuration.String(),
+		"schedule":               config.Schedule,
+		"build_window":           buildWindow,
+		"release_retention_days": config.ReleaseRetention,
+		"log_retention_days":     config.LogRetention,
+		"release_url":            config.ReleaseURL(),
+		"ota_domain":             config.OTADomain,
+		"ota_zone":               config.OTAZone,
+		"replica_regions":        config.ReplicaRegions,
+		"s3_endpoint":            config.S3Endpoint,
+		"notify_emails":          config.NotifyEmails,
+		"notify_sms":             config.NotifySMS,
+		"no_build_alarm_days":    config.NoBuildAlarmDays,
+		"ssh_key":                config.SSHKey,
+		"ssh_cidr":               config.SSHCIDR,
+		"prevent_shutdown":       config.PreventShutdown,
+	}
+}
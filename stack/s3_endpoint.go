@@ -0,0 +1,66 @@
+package stack
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/dan-v/copperheados-stack/checker"
+	log "github.com/sirupsen/logrus"
+)
+
+// storeS3EndpointCredentials stores the credentials build instances and the
+// build checker access the S3 compatible service of a stack with as
+// SecureString parameters, see checker.S3EndpointKeyIDParameter.
+func storeS3EndpointCredentials(config StackConfig) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	ssmClient := ssm.New(sess, &aws.Config{Region: &config.Region})
+
+	parameters := map[string]string{
+		checker.S3EndpointKeyIDParameter(config.Name):  config.S3EndpointKeyID,
+		checker.S3EndpointSecretParameter(config.Name): config.S3EndpointSecret,
+	}
+	for name, value := range parameters {
+		_, err = ssmClient.PutParameter(&ssm.PutParameterInput{
+			Name:        aws.String(name),
+			Description: aws.String(fmt.Sprintf("S3 endpoint credentials for CopperheadOS stack %s", config.Name)),
+			Type:        aws.String(ssm.ParameterTypeSecureString),
+			Value:       aws.String(value),
+			Overwrite:   aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to store S3 endpoint credentials %s: %v", name, err)
+		}
+		_, err = ssmClient.AddTagsToResource(&ssm.AddTagsToResourceInput{
+			ResourceType: aws.String(ssm.ResourceTypeForTaggingParameter),
+			ResourceId:   aws.String(name),
+			Tags:         []*ssm.Tag{{Key: aws.String(StackTagKey), Value: aws.String(config.Name)}},
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to tag S3 endpoint credentials %s: %v", name, err)
+		}
+	}
+	log.Infof("Stored S3 endpoint credentials for build instances and the build checker")
+	return nil
+}
+
+// deleteS3EndpointCredentials removes the S3 endpoint credentials of a stack,
+// if it has any.
+func deleteS3EndpointCredentials(config StackConfig) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	ssmClient := ssm.New(sess, &aws.Config{Region: &config.Region})
+
+	_, err = ssmClient.DeleteParameters(&ssm.DeleteParametersInput{
+		Names: aws.StringSlice([]string{checker.S3EndpointKeyIDParameter(config.Name), checker.S3EndpointSecretParameter(config.Name)}),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to remove S3 endpoint credentials: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BuildWindow restricts the time of day (UTC) builds are allowed to start.
+// Start and End are minutes since midnight and the window wraps around
+// midnight when End is before Start.
+type BuildWindow struct {
+	Start int
+	End   int
+}
+
+func (window BuildWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", window.Start/60, window.Start%60, window.End/60, window.End%60)
+}
+
+// ParseBuildWindow parses a window in the form HH:MM-HH:MM (UTC).
+func ParseBuildWindow(window string) (*BuildWindow, error) {
+	parts := strings.Split(window, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Build window %s must be in the form HH:MM-HH:MM", window)
+	}
+
+	minutes := make([]int, 2)
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("Build window %s must be in the form HH:MM-HH:MM: %v", window, err)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return nil, fmt.Errorf("Build window %s must not start and end at the same time", window)
+	}
+
+	return &BuildWindow{Start: minutes[0], End: minutes[1]}, nil
+}
+
+// NormalizeSchedule turns a schedule into a CloudWatch Events schedule
+// expression. rate(...) and cron(...) expressions are passed through and bare
+// cron fields (e.g. "0 */6 ? * TUE *") are wrapped in cron(...).
+func NormalizeSchedule(schedule string) (string, error) {
+	schedule = strings.TrimSpace(schedule)
+	if strings.HasPrefix(schedule, "rate(") || strings.HasPrefix(schedule, "cron(") {
+		if !strings.HasSuffix(schedule, ")") {
+			return "", fmt.Errorf("Schedule %s is missing a closing parenthesis", schedule)
+		}
+		return schedule, nil
+	}
+
+	if fields := strings.Fields(schedule); len(fields) != 6 {
+		return "", fmt.Errorf("Schedule %s must be a rate(...) expression or a cron expression with 6 fields (minutes hours day-of-month month day-of-week year)", schedule)
+	}
+	return fmt.Sprintf("cron(%s)", schedule), nil
+}
@@ -0,0 +1,60 @@
+package stack
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/dan-v/copperheados-stack/checker"
+)
+
+// suggestedCandidates is how many of the best ranked candidates the suggested
+// spot price covers.
+const suggestedCandidates = 3
+
+// spotPriceHeadroom is how far above the current price of the candidates the
+// suggested spot price is.
+const spotPriceHeadroom = 1.25
+
+// AWSSpotPrices prints the current spot prices of the instance types in every
+// availability zone of a region, best ranked first, with a spot price to
+// deploy with.
+func AWSSpotPrices(region string, instanceTypes []string) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	ec2Client := ec2.New(sess, &aws.Config{Region: &region})
+	candidates, err := checker.RankSpotCandidates(ec2Client, region, instanceTypes, nil)
+	if err != nil {
+		return err
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("No spot prices for %v in %s", instanceTypes, region)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "TYPE\tZONE\tVCPUS\tPRICE\tPRICE/VCPU\tINTERRUPTIONS\n")
+	for _, candidate := range candidates {
+		fmt.Fprintf(w, "%s\t%s\t%d\t$%.4f\t$%.4f\t%s\n", candidate.InstanceType, candidate.Zone, candidate.VCPUs,
+			candidate.Price, candidate.PricePerVCPU(), candidate.InterruptionLabel)
+	}
+	w.Flush()
+
+	best := candidates
+	if len(best) > suggestedCandidates {
+		best = best[:suggestedCandidates]
+	}
+	highest := 0.0
+	for _, candidate := range best {
+		if candidate.Price > highest {
+			highest = candidate.Price
+		}
+	}
+	fmt.Printf("\nSuggested --spot-price %.2f, %.0f%% over the current price of the %d best ranked candidates.\n",
+		math.Ceil(highest*spotPriceHeadroom*100)/100, (spotPriceHeadroom-1)*100, len(best))
+	return nil
+}
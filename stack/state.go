@@ -0,0 +1,330 @@
+package stack
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// AWSStateVersions lists the stored versions of the state of a stack.
+func AWSStateVersions(config StackConfig) error {
+	versions, err := stateVersions(config)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "VERSION ID\tLAST MODIFIED\tSIZE\tLATEST\n")
+	for _, version := range versions {
+		latest := ""
+		if aws.BoolValue(version.IsLatest) {
+			latest = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", aws.StringValue(version.VersionId),
+			aws.TimeValue(version.LastModified).Local().Format("2006-01-02 15:04:05"), aws.Int64Value(version.Size), latest)
+	}
+	return w.Flush()
+}
+
+// AWSStateBackup downloads the state of a stack to a local file. The latest
+// state is used unless a version id is given.
+func AWSStateBackup(config StackConfig, versionID, out string) error {
+	s3Client, err := stateS3Client(config)
+	if err != nil {
+		return err
+	}
+	key, _, err := stateKey(config)
+	if err != nil {
+		return err
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: &config.Name,
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = &versionID
+	}
+	output, err := s3Client.GetObject(input)
+	if err != nil {
+		return fmt.Errorf("Failed to get state from bucket %s: %v", config.Name, err)
+	}
+	defer output.Body.Close()
+
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(file, output.Body); err != nil {
+		return err
+	}
+	log.Infof("Saved %s version %s to %s", key, aws.StringValue(output.VersionId), out)
+	return nil
+}
+
+// AWSStateRestore makes a previous version of the state, or a local backup
+// file, the latest state of a stack. The state that is replaced is kept as a
+// previous version. The state is locked while it is restored, so terraform or
+// the native engine can't write over it.
+func AWSStateRestore(config StackConfig, versionID, file string) error {
+	s3Client, err := stateS3Client(config)
+	if err != nil {
+		return err
+	}
+	key, lockID, err := stateKey(config)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockState(config, lockID, "restore")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var state []byte
+	if file != "" {
+		state, err = ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+	} else {
+		output, err := s3Client.GetObject(&s3.GetObjectInput{
+			Bucket:    &config.Name,
+			Key:       aws.String(key),
+			VersionId: &versionID,
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to get state version %s from bucket %s: %v", versionID, config.Name, err)
+		}
+		defer output.Body.Close()
+		state, err = ioutil.ReadAll(output.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	output, err := s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:               &config.Name,
+		Key:                  aws.String(key),
+		Body:                 bytes.NewReader(state),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to restore state to bucket %s: %v", config.Name, err)
+	}
+
+	// only terraform verifies the state it reads
+	if key == terraformStateKey {
+		err = updateStateDigest(config, state)
+		if err != nil {
+			return err
+		}
+	}
+	log.Infof("Restored %s as version %s", key, aws.StringValue(output.VersionId))
+	return nil
+}
+
+func stateS3Client(config StackConfig) (*s3.S3, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess, s3Config(config)), nil
+}
+
+func stateVersions(config StackConfig) ([]*s3.ObjectVersion, error) {
+	s3Client, err := stateS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	key, _, err := stateKey(config)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []*s3.ObjectVersion{}
+	err = s3Client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: &config.Name,
+		Prefix: aws.String(key),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range page.Versions {
+			if aws.StringValue(version.Key) == key {
+				versions = append(versions, version)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list state versions in bucket %s: %v", config.Name, err)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return aws.TimeValue(versions[i].LastModified).After(aws.TimeValue(versions[j].LastModified))
+	})
+	return versions, nil
+}
+
+// stateKey returns the key of the state a stack is managed with and the id of
+// the lock guarding it. Stacks migrated to the native engine keep their
+// terraform state only as a backup.
+func stateKey(config StackConfig) (string, string, error) {
+	native, err := nativeStateExists(config)
+	if err != nil {
+		return "", "", err
+	}
+	if native {
+		return nativeStateKey, nativeLockID(config.Name), nil
+	}
+	return terraformStateKey, stateLockID(config), nil
+}
+
+// stateExists reports whether there is state of a stack in its bucket, which
+// only deployed stacks have.
+func stateExists(config StackConfig) (bool, error) {
+	key, _, err := stateKey(config)
+	if err != nil {
+		return false, err
+	}
+	s3Client, err := stateS3Client(config)
+	if err != nil {
+		return false, err
+	}
+	_, err = s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: &config.Name,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+			return false, nil
+		}
+		return false, fmt.Errorf("Failed to check for state in bucket %s: %v", config.Name, err)
+	}
+	return true, nil
+}
+
+// stateLockID is the key terraform uses for the state lock of a stack.
+func stateLockID(config StackConfig) string {
+	return config.Name + "/" + terraformStateKey
+}
+
+// lockState takes a state lock of a stack the way terraform does, and returns
+// the function that releases it.
+func lockState(config StackConfig, lockID, operation string) (func(), error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, err
+	}
+	dynamoClient := dynamodb.New(sess, &aws.Config{Region: &config.Region})
+
+	hostname, _ := os.Hostname()
+	// terraform shows the info of locks it can't take
+	info, err := json.Marshal(map[string]string{
+		"ID":        strconv.FormatInt(time.Now().UnixNano(), 10),
+		"Operation": operation,
+		"Who":       fmt.Sprintf("%s@%s", os.Getenv("USER"), hostname),
+		"Version":   config.Version,
+		"Created":   time.Now().UTC().Format(time.RFC3339),
+		"Path":      lockID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(lockTableName(config.Name)),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(lockID)},
+			"Info":   {S: aws.String(string(info))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(LockID)"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			// describe who holds the terraform lock
+			if lockID == stateLockID(config) {
+				if err := checkStateUnlocked(config); err != nil {
+					return nil, err
+				}
+			}
+			return nil, fmt.Errorf("State of stack %s is locked, wait for the running operation to finish", config.Name)
+		}
+		return nil, fmt.Errorf("Failed to lock state: %v", err)
+	}
+
+	return func() {
+		_, err := dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName: aws.String(lockTableName(config.Name)),
+			Key: map[string]*dynamodb.AttributeValue{
+				"LockID": {S: aws.String(lockID)},
+			},
+		})
+		if err != nil {
+			log.Warnf("Failed to release state lock, remove item %s from table %s: %v", lockID, lockTableName(config.Name), err)
+		}
+	}, nil
+}
+
+func checkStateUnlocked(config StackConfig) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	dynamoClient := dynamodb.New(sess, &aws.Config{Region: &config.Region})
+
+	output, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(lockTableName(config.Name)),
+		Key: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(stateLockID(config))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to check state lock: %v", err)
+	}
+	if len(output.Item) > 0 {
+		info := ""
+		if attribute, ok := output.Item["Info"]; ok {
+			info = aws.StringValue(attribute.S)
+		}
+		return fmt.Errorf("State of stack %s is locked, wait for the running operation to finish: %s", config.Name, info)
+	}
+	return nil
+}
+
+// updateStateDigest stores the md5 digest terraform uses to verify the state it
+// reads from S3 is consistent with the last write.
+func updateStateDigest(config StackConfig, state []byte) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	dynamoClient := dynamodb.New(sess, &aws.Config{Region: &config.Region})
+
+	digest := md5.Sum(state)
+	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(lockTableName(config.Name)),
+		Item: map[string]*dynamodb.AttributeValue{
+			"LockID": {S: aws.String(stateLockID(config) + "-md5")},
+			"Digest": {S: aws.String(hex.EncodeToString(digest[:]))},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to update state digest: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package stack
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/dan-v/copperheados-stack/checker"
+)
+
+// AWSStatus prints the version and last build of a stack, whether a build
+// holds the build lock, whether there is a new release to build, the latest
+// OTA update of each device and, for stacks replicating their release bucket,
+// whether it has been replicated.
+func AWSStatus(config StackConfig) error {
+	summary, err := summarizeStack(config)
+	if err != nil {
+		return err
+	}
+
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	s3Client := s3.New(sess, s3Config(config))
+	releaseBucket := config.Name + "-release"
+
+	var replicas []releaseReplica
+	// replication needs the release bucket on aws s3, see --replica-region
+	if config.S3Endpoint == "" {
+		replicas, err = releaseReplicas(sess, s3Client, releaseBucket)
+		if err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Stack:\t%s (%s)\n", config.Name, config.Region)
+	fmt.Fprintf(w, "Version:\t%s\n", summary.version)
+	if summary.lastBuild == "-" {
+		fmt.Fprintf(w, "Last build:\tnone\n")
+	} else {
+		fmt.Fprintf(w, "Last build:\t%s %s\n", summary.lastBuild, summary.status)
+	}
+	buildLock, err := checker.BuildLock(dynamodb.New(sess, &aws.Config{Region: &config.Region}), config.Name)
+	if err != nil {
+		return err
+	}
+	if buildLock == "" {
+		buildLock = "free"
+	}
+	fmt.Fprintf(w, "Build lock:\t%s\n", buildLock)
+	for _, replica := range replicas {
+		fmt.Fprintf(w, "Replica:\t%s (%s)\n", replica.bucket, replica.region)
+	}
+	if len(replicas) == 0 {
+		fmt.Fprintf(w, "Replica:\tnone\n")
+	}
+
+	// ask the build checker whether there is something to build, like the scheduled checks do
+	releaseURL := config.ReleaseURL()
+	if checkerConfig, err := deployedChecker(config); err == nil {
+		releaseURL = checkerConfig.ReleaseURL
+	}
+
+	for _, device := range summary.devices {
+		if release, err := checker.CheckRelease(releaseURL, device); err != nil {
+			fmt.Fprintf(w, "%s update:\tunknown, %v\n", device, err)
+		} else if release.UpdateAvailable() {
+			fmt.Fprintf(w, "%s update:\tnew release %d available, built %d\n", device, release.Official, release.Built)
+		} else {
+			fmt.Fprintf(w, "%s update:\tup to date\n", device)
+		}
+
+		channel := device + "-stable"
+		metadata, err := getReleaseObject(s3Client, releaseBucket, channel)
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(metadata)
+		if len(fields) == 0 {
+			fmt.Fprintf(w, "%s:\tno release yet\n", device)
+			continue
+		}
+		// the channel holds "<build date> <build timestamp> <official version>"
+		ota := fmt.Sprintf("%s-ota_update-%s.zip", device, fields[0])
+		fmt.Fprintf(w, "%s:\t%s\n", device, ota)
+		if len(replicas) == 0 {
+			continue
+		}
+		for _, key := range []string{channel, ota} {
+			status, err := replicationStatus(s3Client, releaseBucket, replicas, key)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "  %s:\t%s\n", key, status)
+		}
+	}
+	return w.Flush()
+}
+
+// releaseReplica is a bucket the release bucket replicates to.
+type releaseReplica struct {
+	bucket string
+	region string
+	client *s3.S3
+}
+
+// releaseReplicas returns the buckets the release bucket replicates to, one
+// per replication rule, in the order of the rules.
+func releaseReplicas(sess *session.Session, s3Client *s3.S3, releaseBucket string) ([]releaseReplica, error) {
+	output, err := s3Client.GetBucketReplication(&s3.GetBucketReplicationInput{Bucket: &releaseBucket})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to get replication of bucket %s: %v", releaseBucket, err)
+	}
+	replicas := []releaseReplica{}
+	for _, rule := range output.ReplicationConfiguration.Rules {
+		if rule.Destination == nil {
+			continue
+		}
+		destination, err := arn.Parse(aws.StringValue(rule.Destination.Bucket))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse replica of bucket %s: %v", releaseBucket, err)
+		}
+		location, err := s3Client.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: &destination.Resource})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get region of bucket %s: %v", destination.Resource, err)
+		}
+		region := s3.NormalizeBucketLocation(aws.StringValue(location.LocationConstraint))
+		replicas = append(replicas, releaseReplica{
+			bucket: destination.Resource,
+			region: region,
+			client: s3.New(sess, &aws.Config{Region: &region}),
+		})
+	}
+	return replicas, nil
+}
+
+func getReleaseObject(s3Client *s3.S3, bucket, key string) (string, error) {
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("Failed to get %s from bucket %s: %v", key, bucket, err)
+	}
+	defer output.Body.Close()
+	body, err := ioutil.ReadAll(output.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// replicationStatus describes whether an object has been replicated, using the
+// replication status S3 keeps on the original, which is complete once every
+// replica is. Replicas keep the modification time of the original, so there is
+// no telling how long replication took.
+func replicationStatus(s3Client *s3.S3, bucket string, replicas []releaseReplica, key string) (string, error) {
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: &bucket, Key: &key})
+	if err != nil {
+		if isNotFound(err) {
+			return "missing", nil
+		}
+		return "", fmt.Errorf("Failed to get %s from bucket %s: %v", key, bucket, err)
+	}
+
+	switch aws.StringValue(head.ReplicationStatus) {
+	case s3.ReplicationStatusPending:
+		return fmt.Sprintf("pending, uploaded %s ago", time.Since(aws.TimeValue(head.LastModified)).Round(time.Second)), nil
+	case s3.ReplicationStatusFailed:
+		return "replication FAILED", nil
+	case s3.ReplicationStatusComplete:
+		for _, replica := range replicas {
+			_, err := replica.client.HeadObject(&s3.HeadObjectInput{Bucket: &replica.bucket, Key: &key})
+			if err != nil {
+				if isNotFound(err) {
+					// replaced or expired in the replica since
+					return fmt.Sprintf("replicated, missing in %s", replica.bucket), nil
+				}
+				return "", fmt.Errorf("Failed to get %s from bucket %s: %v", key, replica.bucket, err)
+			}
+		}
+		return "replicated", nil
+	}
+	// uploaded before replication was enabled
+	return "not replicated", nil
+}
@@ -0,0 +1,117 @@
+package stack
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sts"
+	log "github.com/sirupsen/logrus"
+)
+
+// SNS reports this instead of an arn for subscriptions awaiting confirmation
+const snsPendingConfirmation = "PendingConfirmation"
+
+var smsNumber = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// ValidSMSNumber reports whether number is in the E.164 format SNS expects,
+// e.g. +15555550100.
+func ValidSMSNumber(number string) bool {
+	return smsNumber.MatchString(number)
+}
+
+// AWSNotifyList prints the subscriptions of the SNS topic of a stack and
+// whether they have been confirmed.
+func AWSNotifyList(config StackConfig) error {
+	snsClient, topicArn, err := stackTopic(config)
+	if err != nil {
+		return err
+	}
+	subscriptions, err := topicSubscriptions(snsClient, topicArn)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "PROTOCOL\tENDPOINT\tSTATUS\n")
+	for _, subscription := range subscriptions {
+		status := "confirmed"
+		if aws.StringValue(subscription.SubscriptionArn) == snsPendingConfirmation {
+			status = "pending confirmation"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", aws.StringValue(subscription.Protocol), aws.StringValue(subscription.Endpoint), status)
+	}
+	return w.Flush()
+}
+
+// subscribeEmails subscribes the notification emails of a stack to its SNS
+// topic. Email subscriptions have to be confirmed by the recipient, which
+// terraform can't wait for, so they are created through the SNS API instead.
+// Addresses are only ever added, recipients unsubscribe through the link in
+// every notification.
+func subscribeEmails(config StackConfig) error {
+	if len(config.NotifyEmails) == 0 {
+		return nil
+	}
+	snsClient, topicArn, err := stackTopic(config)
+	if err != nil {
+		return err
+	}
+	subscriptions, err := topicSubscriptions(snsClient, topicArn)
+	if err != nil {
+		return err
+	}
+
+	subscribed := map[string]bool{}
+	for _, subscription := range subscriptions {
+		if aws.StringValue(subscription.Protocol) == "email" {
+			subscribed[strings.ToLower(aws.StringValue(subscription.Endpoint))] = true
+		}
+	}
+	for _, email := range config.NotifyEmails {
+		if subscribed[strings.ToLower(email)] {
+			continue
+		}
+		_, err := snsClient.Subscribe(&sns.SubscribeInput{
+			TopicArn: aws.String(topicArn),
+			Protocol: aws.String("email"),
+			Endpoint: aws.String(email),
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to subscribe %s to build notifications: %v", email, err)
+		}
+		log.Infof("Subscribed %s to build notifications, a confirmation email has been sent", email)
+	}
+	return nil
+}
+
+func stackTopic(config StackConfig) (*sns.SNS, string, error) {
+	sess, err := awsSession()
+	if err != nil {
+		return nil, "", err
+	}
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to get AWS account id: %v", err)
+	}
+	topicArn := fmt.Sprintf("arn:aws:sns:%s:%s:%s", config.Region, aws.StringValue(identity.Account), config.Name)
+	return sns.New(sess, &aws.Config{Region: &config.Region}), topicArn, nil
+}
+
+func topicSubscriptions(snsClient *sns.SNS, topicArn string) ([]*sns.Subscription, error) {
+	subscriptions := []*sns.Subscription{}
+	err := snsClient.ListSubscriptionsByTopicPages(&sns.ListSubscriptionsByTopicInput{
+		TopicArn: aws.String(topicArn),
+	}, func(page *sns.ListSubscriptionsByTopicOutput, lastPage bool) bool {
+		subscriptions = append(subscriptions, page.Subscriptions...)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list subscriptions of %s: %v", topicArn, err)
+	}
+	return subscriptions, nil
+}
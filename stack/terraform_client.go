@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"syscall"
 
 	"github.com/dan-v/copperheados-stack/templates"
 	log "github.com/sirupsen/logrus"
@@ -48,21 +49,7 @@ func NewTerraformClient(config *TerraformConfig, stdout, stderr io.Writer) (*Ter
 		return nil, err
 	}
 
-	// write out shell script
-	err = ioutil.WriteFile(config.TempDir.Path(ShellScriptFilename), config.ShellScriptBytes, 0644)
-	if err != nil {
-		return nil, err
-	}
-
-	// write out spot lambda function and zip it up
-	err = ioutil.WriteFile(config.TempDir.Path(LambdaSpotFunctionFilename), config.LambdaSpotFunctionBytes, 0644)
-	if err != nil {
-		return nil, err
-	}
-	files := []string{config.TempDir.Path(LambdaSpotFunctionFilename)}
-	output := config.TempDir.Path(LambdaSpotZipFilename)
-	err = zipFiles(output, files)
-	if err != nil {
+	if err := writeStackFiles(config); err != nil {
 		return nil, err
 	}
 
@@ -161,3 +148,21 @@ func setupBinary(tempDir *TempDir) error {
 
 	return nil
 }
+
+// Plan refreshes the state and shows the changes an apply would make. It
+// returns true when there are any.
+func (client *TerraformClient) Plan() (bool, error) {
+	err := client.terraform([]string{
+		"plan",
+		"-input=false",
+		"-lock=false",
+		"-detailed-exitcode",
+	}, client.stdout)
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// -detailed-exitcode exits with 2 when the plan isn't empty
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 2 {
+			return true, nil
+		}
+	}
+	return false, err
+}
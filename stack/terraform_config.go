@@ -1,32 +1,68 @@
 package stack
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/dan-v/copperheados-stack/templates"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	LambdaSpotFunctionFilename = "lambda_spot_function.py"
-	LambdaSpotZipFilename      = "lambda_spot.zip"
-	ShellScriptFilename        = "chos.sh"
+	LambdaBuildBootstrapFilename = "bootstrap"
+	LambdaBuildZipFilename       = "lambda_build.zip"
+	LambdaNotifyFunctionFilename = "lambda_notify_function.py"
+	LambdaNotifyZipFilename      = "lambda_notify.zip"
+	ShellScriptFilename          = "chos.sh"
 )
 
 type TerraformConfig struct {
-	Name                    string
-	Region                  string
-	Device                  string
-	TempDir                 *TempDir
-	ShellScriptFile         string
-	ShellScriptBytes        []byte
-	LambdaSpotZipFile       string
-	LambdaSpotFunctionBytes []byte
-	PreventShutdown         bool
+	Name                      string
+	Region                    string
+	Device                    string
+	SSHKey                    string
+	SSHCIDR                   string
+	Schedule                  string
+	BuildWindow               *BuildWindow
+	Version                   string
+	ReleaseRetention          int
+	LogRetention              int
+	TempDir                   *TempDir
+	ShellScriptFile           string
+	ShellScriptBytes          []byte
+	LambdaBuildZipFile        string
+	CheckerBinaryBytes        []byte
+	CheckerConfig             string
+	LambdaNotifyZipFile       string
+	LambdaNotifyFunctionBytes []byte
+	PreventShutdown           bool
+	OTADomain                 string
+	OTAZone                   string
+	ReplicaRegions            []string
+	NotifySMS                 []string
+	NoBuildAlarmDays          int
+	S3Endpoint                string
+	DashboardBody             string
 }
 
 func generateTerraformConfig(config StackConfig) (*TerraformConfig, error) {
-	renderedLambdaSpotFunction, err := renderTemplate(templates.LambdaSpotFunctionTemplate, config)
+	checkerBinary, err := checkerBinary(config)
 	if err != nil {
-		log.Fatalln("Failed to render Lambda spot function:", err)
+		return nil, err
+	}
+	checkerConfig, err := json.Marshal(checkerConfig(config))
+	if err != nil {
+		return nil, err
+	}
+
+	renderedLambdaNotifyFunction, err := renderTemplate(templates.LambdaNotifyFunctionTemplate, config)
+	if err != nil {
+		log.Fatalln("Failed to render Lambda notify function:", err)
 	}
 
 	renderedCopperheadShellScript, err := renderTemplate(templates.CopperheadShellScriptTemplate, config)
@@ -40,16 +76,120 @@ func generateTerraformConfig(config StackConfig) (*TerraformConfig, error) {
 	}
 
 	conf := TerraformConfig{
-		Name:                    config.Name,
-		Region:                  config.Region,
-		Device:                  config.Device,
-		TempDir:                 tempDir,
-		ShellScriptFile:         tempDir.Path(ShellScriptFilename),
-		ShellScriptBytes:        renderedCopperheadShellScript,
-		LambdaSpotZipFile:       tempDir.Path(LambdaSpotZipFilename),
-		LambdaSpotFunctionBytes: renderedLambdaSpotFunction,
-		PreventShutdown:         config.PreventShutdown,
+		Name:                      config.Name,
+		Region:                    config.Region,
+		Device:                    config.Device,
+		SSHKey:                    config.SSHKey,
+		SSHCIDR:                   config.SSHCIDR,
+		Schedule:                  config.Schedule,
+		BuildWindow:               config.BuildWindow,
+		Version:                   config.Version,
+		ReleaseRetention:          config.ReleaseRetention,
+		LogRetention:              config.LogRetention,
+		TempDir:                   tempDir,
+		ShellScriptFile:           tempDir.Path(ShellScriptFilename),
+		ShellScriptBytes:          renderedCopperheadShellScript,
+		LambdaBuildZipFile:        tempDir.Path(LambdaBuildZipFilename),
+		CheckerBinaryBytes:        checkerBinary,
+		CheckerConfig:             string(checkerConfig),
+		LambdaNotifyZipFile:       tempDir.Path(LambdaNotifyZipFilename),
+		LambdaNotifyFunctionBytes: renderedLambdaNotifyFunction,
+		PreventShutdown:           config.PreventShutdown,
+		OTADomain:                 config.OTADomain,
+		OTAZone:                   config.OTAZone,
+		ReplicaRegions:            config.ReplicaRegions,
+		NotifySMS:                 config.NotifySMS,
+		NoBuildAlarmDays:          config.NoBuildAlarmDays,
+		S3Endpoint:                config.S3Endpoint,
+	}
+
+	dashboardBody, err := renderTemplate(templates.CloudWatchDashboardTemplate, conf)
+	if err != nil {
+		return nil, err
 	}
+	conf.DashboardBody = string(dashboardBody)
 
 	return &conf, nil
 }
+
+// writeStackFiles writes the build script and the zipped Lambda functions of
+// a stack to its temp dir.
+func writeStackFiles(config *TerraformConfig) error {
+	// write out shell script
+	err := ioutil.WriteFile(config.TempDir.Path(ShellScriptFilename), config.ShellScriptBytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	// write out the build checker, which lambda runs as a custom runtime, and zip it up
+	err = ioutil.WriteFile(config.TempDir.Path(LambdaBuildBootstrapFilename), config.CheckerBinaryBytes, 0755)
+	if err != nil {
+		return err
+	}
+	err = zipFiles(config.TempDir.Path(LambdaBuildZipFilename), []string{config.TempDir.Path(LambdaBuildBootstrapFilename)})
+	if err != nil {
+		return err
+	}
+
+	// write out notify lambda function and zip it up
+	err = ioutil.WriteFile(config.TempDir.Path(LambdaNotifyFunctionFilename), config.LambdaNotifyFunctionBytes, 0644)
+	if err != nil {
+		return err
+	}
+	return zipFiles(config.TempDir.Path(LambdaNotifyZipFilename), []string{config.TempDir.Path(LambdaNotifyFunctionFilename)})
+}
+
+// CheckerConfigString is the config of the build checker as a terraform
+// string.
+func (config TerraformConfig) CheckerConfigString() string {
+	return strings.Replace(strconv.Quote(config.CheckerConfig), "${", "$${", -1)
+}
+
+// ReplicaName names the provider and the bucket resource of the release
+// replica in region, e.g. replica_eu_central_1.
+func (config TerraformConfig) ReplicaName(region string) string {
+	return "replica_" + strings.Replace(region, "-", "_", -1)
+}
+
+// otaZone returns the Route53 hosted zone the OTA domain of a stack lives in,
+// either the one given with --ota-zone or the hosted zone of the account that
+// is the longest match of the domain, e.g. example.org for
+// ota.updates.example.org or example.co.uk for updates.example.co.uk. It is
+// resolved before generating the terraform config, which render generates
+// without touching AWS.
+func otaZone(config StackConfig) (string, error) {
+	if config.OTADomain == "" || config.OTAZone != "" {
+		return config.OTAZone, nil
+	}
+	sess, err := awsSession()
+	if err != nil {
+		return "", err
+	}
+	route53Client := route53.New(sess)
+	zone := ""
+	input := &route53.ListHostedZonesByNameInput{}
+	for {
+		output, err := route53Client.ListHostedZonesByName(input)
+		if err != nil {
+			return "", fmt.Errorf("Failed to list Route53 hosted zones: %v", err)
+		}
+		for _, hostedZone := range output.HostedZones {
+			if hostedZone.Config != nil && aws.BoolValue(hostedZone.Config.PrivateZone) {
+				continue
+			}
+			name := strings.TrimSuffix(aws.StringValue(hostedZone.Name), ".")
+			if (config.OTADomain == name || strings.HasSuffix(config.OTADomain, "."+name)) && len(name) > len(zone) {
+				zone = name
+			}
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		input.DNSName = output.NextDNSName
+		input.HostedZoneId = output.NextHostedZoneId
+	}
+	if zone == "" {
+		return "", fmt.Errorf("No Route53 hosted zone found for --ota-domain %s, create one or pass it with --ota-zone", config.OTADomain)
+	}
+	return zone, nil
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 func unzip(src, dest string) error {
@@ -89,6 +90,15 @@ func zipFiles(filename string, files []string) error {
 		// see http://golang.org/pkg/archive/zip/#pkg-constants
 		header.Method = zip.Deflate
 
+		// the same files always give the same zip, so lambda functions are
+		// only updated when their code changes
+		header.SetModTime(zipModTime)
+		if info.Mode()&0111 != 0 {
+			header.SetMode(0755)
+		} else {
+			header.SetMode(0644)
+		}
+
 		writer, err := zipWriter.CreateHeader(header)
 		if err != nil {
 			return err
@@ -101,6 +111,8 @@ func zipFiles(filename string, files []string) error {
 	return nil
 }
 
+var zipModTime = time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC)
+
 type TempDir struct {
 	path string
 }
@@ -0,0 +1,266 @@
+package stack
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/sirupsen/logrus"
+)
+
+// stackMetaKey is the object in the stack bucket recording which version of
+// copperheados-stack last deployed the stack.
+const stackMetaKey = "stack.json"
+
+// stackSchemaVersion is the layout of resources, buckets and files the
+// current version deploys. It is increased together with a new migration
+// whenever that layout changes in a way existing stacks have to be upgraded
+// for.
+const stackSchemaVersion = 1
+
+type stackMeta struct {
+	ToolVersion   string    `json:"tool_version"`
+	SchemaVersion int       `json:"schema_version"`
+	Region        string    `json:"region"`
+	Devices       []string  `json:"devices"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type migration struct {
+	// schemaVersion is the version of the stack after the migration ran
+	schemaVersion int
+	description   string
+	run           func(config StackConfig) error
+}
+
+// migrations upgrade deployed stacks to stackSchemaVersion. They run in order
+// after the resources of a stack have been applied, starting with the first
+// one newer than the schema version of the stack. Stacks deployed before
+// versions were recorded are at schema version 0. Migrations also run for new
+// stacks, so they have to handle there being nothing to migrate.
+var migrations = []migration{
+	{
+		schemaVersion: 1,
+		description:   "encrypt signing keys at rest",
+		run:           encryptKeys,
+	},
+}
+
+// checkStackVersion refuses to deploy a stack with an older version of
+// copperheados-stack than the one that last deployed it, which may not
+// understand the stack anymore.
+func checkStackVersion(config StackConfig, meta *stackMeta) error {
+	if meta == nil {
+		return nil
+	}
+	if meta.SchemaVersion > stackSchemaVersion {
+		return fmt.Errorf("Stack %s was deployed by copperheados-stack %s with schema version %d, this version only supports up to %d. Use copperheados-stack %s or newer",
+			config.Name, meta.ToolVersion, meta.SchemaVersion, stackSchemaVersion, meta.ToolVersion)
+	}
+	newer, err := versionNewer(meta.ToolVersion, config.Version)
+	if err != nil {
+		log.Warnf("Not checking for a downgrade of stack %s: %v", config.Name, err)
+		return nil
+	}
+	if newer {
+		return fmt.Errorf("Stack %s was deployed by copperheados-stack %s, refusing to downgrade it to %s",
+			config.Name, meta.ToolVersion, config.Version)
+	}
+	return nil
+}
+
+// upgradeStack runs the migrations a stack hasn't had yet and records the
+// current version in the stack bucket.
+func upgradeStack(config StackConfig, meta *stackMeta) error {
+	schemaVersion := 0
+	if meta != nil {
+		schemaVersion = meta.SchemaVersion
+	}
+	for _, m := range migrations {
+		if m.schemaVersion <= schemaVersion {
+			continue
+		}
+		log.Infof("Migrating stack %s to schema version %d: %s", config.Name, m.schemaVersion, m.description)
+		if err := m.run(config); err != nil {
+			return fmt.Errorf("Failed to migrate stack %s to schema version %d: %v", config.Name, m.schemaVersion, err)
+		}
+		// record every step, so a failed migration is retried by the next deploy
+		// without running the ones before it again
+		if err := saveStackMeta(config, m.schemaVersion); err != nil {
+			return err
+		}
+		schemaVersion = m.schemaVersion
+	}
+	return saveStackMeta(config, schemaVersion)
+}
+
+// loadStackMeta returns the recorded version of a stack, or nil for stacks
+// deployed before versions were recorded.
+func loadStackMeta(config StackConfig) (*stackMeta, error) {
+	s3Client, err := stateS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	output, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: &config.Name,
+		Key:    aws.String(stackMetaKey),
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to get %s from bucket %s: %v", stackMetaKey, config.Name, err)
+	}
+	defer output.Body.Close()
+
+	meta := &stackMeta{}
+	if err := json.NewDecoder(output.Body).Decode(meta); err != nil {
+		return nil, fmt.Errorf("Failed to parse %s from bucket %s: %v", stackMetaKey, config.Name, err)
+	}
+	return meta, nil
+}
+
+func saveStackMeta(config StackConfig, schemaVersion int) error {
+	s3Client, err := stateS3Client(config)
+	if err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(stackMeta{
+		ToolVersion:   config.Version,
+		SchemaVersion: schemaVersion,
+		Region:        config.Region,
+		Devices:       []string{config.Device},
+		UpdatedAt:     time.Now().UTC(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:      &config.Name,
+		Key:         aws.String(stackMetaKey),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to save %s to bucket %s: %v", stackMetaKey, config.Name, err)
+	}
+	return nil
+}
+
+func deleteStackMeta(config StackConfig) error {
+	s3Client, err := stateS3Client(config)
+	if err != nil {
+		return err
+	}
+	_, err = s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: &config.Name,
+		Key:    aws.String(stackMetaKey),
+	})
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("Failed to delete %s from bucket %s: %v", stackMetaKey, config.Name, err)
+	}
+	return nil
+}
+
+// versionNewer reports whether version a is newer than version b. Both have
+// to be dotted numbers like 0.0.10, development builds can't be compared.
+func versionNewer(a, b string) (bool, error) {
+	aParts, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	bParts, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			aPart = aParts[i]
+		}
+		if i < len(bParts) {
+			bPart = bParts[i]
+		}
+		if aPart != bPart {
+			return aPart > bPart, nil
+		}
+	}
+	return false, nil
+}
+
+func parseVersion(version string) ([]int, error) {
+	var parts []int
+	for _, part := range strings.Split(strings.TrimPrefix(version, "v"), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("Version %s is not a release version", version)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+// encryptKeys enables default encryption on the keys bucket and encrypts the
+// signing keys uploaded before it was enabled by copying them onto
+// themselves.
+func encryptKeys(config StackConfig) error {
+	sess, err := awsSession()
+	if err != nil {
+		return err
+	}
+	s3Client := s3.New(sess, s3Config(config))
+
+	bucket := config.Name + "-keys"
+	if config.S3Endpoint != "" {
+		// S3 compatible servers often only support encryption with a key management service set up
+		log.Warnf("Not encrypting bucket %s on %s, configure encryption on the server instead", bucket, config.S3Endpoint)
+		return nil
+	}
+	_, err = s3Client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: &bucket,
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{{
+				ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+					SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256),
+				},
+			}},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to enable encryption on bucket %s: %v", bucket, err)
+	}
+
+	var copyErr error
+	err = s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{Bucket: &bucket}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			head, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: &bucket, Key: object.Key})
+			if err != nil {
+				copyErr = fmt.Errorf("Failed to get %s from bucket %s: %v", aws.StringValue(object.Key), bucket, err)
+				return false
+			}
+			if head.ServerSideEncryption != nil {
+				continue
+			}
+			_, err = s3Client.CopyObject(&s3.CopyObjectInput{
+				Bucket:               &bucket,
+				Key:                  object.Key,
+				CopySource:           aws.String(bucket + "/" + aws.StringValue(object.Key)),
+				ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+			})
+			if err != nil {
+				copyErr = fmt.Errorf("Failed to encrypt %s in bucket %s: %v", aws.StringValue(object.Key), bucket, err)
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to list objects in bucket %s: %v", bucket, err)
+	}
+	return copyErr
+}
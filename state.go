@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var stateVersionID, stateFile string
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Manage the stored state of a stack, terraform or native engine",
+}
+
+var stateVersionsCmd = &cobra.Command{
+	Use:   "versions",
+	Short: "List the stored versions of the state",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSStateVersions(stack.StackConfig{
+			Name:       name,
+			Region:     region,
+			S3Endpoint: s3Endpoint,
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+var stateBackupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Download the latest or a previous version of the state to a local file",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSStateBackup(stack.StackConfig{
+			Name:       name,
+			Region:     region,
+			S3Endpoint: s3Endpoint,
+		}, stateVersionID, stateFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+var stateRestoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Make a previous version of the state, or a local backup, the latest state",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if (stateVersionID == "") == (stateFile == "") {
+			return errors.New("Must specify either --version-id or --file to restore from")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSStateRestore(stack.StackConfig{
+			Name:       name,
+			Region:     region,
+			S3Endpoint: s3Endpoint,
+		}, stateVersionID, stateFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	addStackFlags(stateVersionsCmd)
+	addS3EndpointFlag(stateVersionsCmd)
+
+	addStackFlags(stateBackupCmd)
+	addS3EndpointFlag(stateBackupCmd)
+	stateBackupCmd.Flags().StringVar(&stateVersionID, "version-id", "", "version of the state to back up. defaults to the latest version.")
+	stateBackupCmd.Flags().StringVarP(&stateFile, "out", "o", "", "file to save the state to.")
+	stateBackupCmd.MarkFlagRequired("out")
+
+	addStackFlags(stateRestoreCmd)
+	addS3EndpointFlag(stateRestoreCmd)
+	stateRestoreCmd.Flags().StringVar(&stateVersionID, "version-id", "", "version of the state to restore, see 'state versions'.")
+	stateRestoreCmd.Flags().StringVar(&stateFile, "file", "", "local state backup to restore.")
+
+	stateCmd.AddCommand(stateVersionsCmd, stateBackupCmd, stateRestoreCmd)
+	RootCmd.AddCommand(stateCmd)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the version, last build and latest OTA update of a stack, and whether it has been replicated",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSStatus(stack.StackConfig{
+			Name:       name,
+			Region:     region,
+			S3Endpoint: s3Endpoint,
+		})
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	addStackFlags(statusCmd)
+	addS3EndpointFlag(statusCmd)
+	RootCmd.AddCommand(statusCmd)
+}
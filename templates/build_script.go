@@ -8,26 +8,58 @@ Usage: $(basename $0) DEVICE_NAME
 
 Options:
 	-A do a full run
+	-l how the build instance was launched (spot|spot-raised|on-demand|local)
+	-L token of the build lock to release when the build is done
 ENDHELP
 
 DEVICE=$1
 
+<% if .LocalBuildDir %>
+# local build, keys, releases and logs are kept in directories and notifications go to stdout
+LOCAL_BUILD=true
+PREVENT_SHUTDOWN=true
+LOCAL_BUILD_DIR='<% .LocalBuildDir %>'
+KEYS_STORAGE="${LOCAL_BUILD_DIR}/keys"
+RELEASE_STORAGE="${LOCAL_BUILD_DIR}/release"
+LOGS_STORAGE="${LOCAL_BUILD_DIR}/logs"
+CHOS_DIR="${LOCAL_BUILD_DIR}/copperheados"
+BUILD_LOG="${LOCAL_BUILD_DIR}/build.log"
+mkdir --parents "${KEYS_STORAGE}" "${RELEASE_STORAGE}" "${LOGS_STORAGE}"
+<% else %>
+LOCAL_BUILD=false
 PREVENT_SHUTDOWN=<% .PreventShutdown %>
 
 # AWS config
-AWS_KEYS_BUCKET='<% .Name %>-keys'
-AWS_RELEASE_BUCKET='<% .Name %>-release'
-AWS_LOGS_BUCKET='<% .Name %>-logs'
+KEYS_STORAGE='s3://<% .Name %>-keys'
+RELEASE_STORAGE='s3://<% .Name %>-release'
+LOGS_STORAGE='s3://<% .Name %>-logs'
+<% if .S3Endpoint %>
+S3_ENDPOINT_ARGS=(--endpoint-url '<% .S3Endpoint %>')
+aws configure set default.s3.addressing_style path
+# the endpoint doesn't accept the credentials of the instance profile
+S3_ENDPOINT_ENV=(env
+  "AWS_ACCESS_KEY_ID=$(aws --region <% .Region %> ssm get-parameter --name '/<% .Name %>/s3-endpoint/access-key-id' --with-decryption --query Parameter.Value --output text)"
+  "AWS_SECRET_ACCESS_KEY=$(aws --region <% .Region %> ssm get-parameter --name '/<% .Name %>/s3-endpoint/secret-access-key' --with-decryption --query Parameter.Value --output text)")
+<% else %>
+S3_ENDPOINT_ARGS=()
+S3_ENDPOINT_ENV=()
+<% end %>
+CHOS_DIR="$HOME/copperheados"
+BUILD_LOG=/var/log/cloud-init-output.log
+AWS_LOG_GROUP='<% .Name %>-builds'
+AWS_LOCK_TABLE='<% .Name %>-terraform-lock'
+BUILD_LOCK_ID='<% .Name %>/build'
 AWS_SNS_ARN=$(aws --region <% .Region %> sns list-topics --query 'Topics[0].TopicArn' --output text | cut -d":" -f1,2,3,4,5)':<% .Name %>'
+<% end %>
+EVENTS_STORAGE="${LOGS_STORAGE}/${DEVICE}/builds"
 
 # targets
 BUILD_TARGET="release aosp_${DEVICE} user"
 RELEASE_CHANNEL="${DEVICE}-stable"
 
-CHOS_DIR="$HOME/copperheados"
 CERTIFICATE_SUBJECT='/CN=Unofficial CopperheadOS'
 OFFICIAL_RELEASE_URL='https://release.copperhead.co'
-UNOFFICIAL_RELEASE_URL="https://${AWS_RELEASE_BUCKET}.s3.amazonaws.com"
+UNOFFICIAL_RELEASE_URL='<% .ReleaseURL %>'
 
 read -ra metadata <<< "$(wget --quiet -O - "${OFFICIAL_RELEASE_URL}/${RELEASE_CHANNEL}")"
 OFFICIAL_DATE="${metadata[0]}"
@@ -36,10 +68,37 @@ OFFICIAL_VERSION="${metadata[2]}"
 TAG="${OFFICIAL_VERSION}.${OFFICIAL_DATE}"
 BRANCH="refs/tags/${TAG}"
 
+# build events are written to ${EVENTS_STORAGE}/${BUILD_ID}/events
+BUILD_ID=$(date +%s)
+BUILD_STAGE=''
+EVENT_SEQ=0
+OTA_SIZE=0
+INCREMENTAL_SIZE=0
+REPO_SYNC_RETRIES=0
+REPO_SYNC_ATTEMPTS=10
+
+# set by classify_failure for failed builds
+FAILURE_REASON=''
+FAILURE_LINES=''
+LOG_URL=''
+LOG_COMMAND=''
+SPOT_INTERRUPTION_MARKER=/tmp/chos-spot-interruption
+SPOT_WATCH_PID=''
+
+# set by aws_instance_info, the spot price is empty on on-demand instances
+INSTANCE_TYPE=''
+SPOT_PRICE=''
+
+# output is streamed to the ${DEVICE}/${BUILD_ID} stream of ${AWS_LOG_GROUP} while building on aws
+LOG_STREAM_STATE=/tmp/chos-log-stream
+LOG_STREAM_PID=''
+
 # make getopts ignore $1 since it is $DEVICE
 OPTIND=2
 FULL_RUN=false
-while getopts ":hA" opt; do
+LAUNCH_PATH=spot
+BUILD_LOCK_TOKEN=''
+while getopts ":hAl:L:" opt; do
   case $opt in
     h)
       echo "${HELP}"
@@ -47,6 +106,12 @@ while getopts ":hA" opt; do
     A)
       FULL_RUN=true
       ;;
+    l)
+      LAUNCH_PATH="${OPTARG}"
+      ;;
+    L)
+      BUILD_LOCK_TOKEN="${OPTARG}"
+      ;;
     \?)
       echo "${HELP}"
       ;;
@@ -54,15 +119,36 @@ while getopts ":hA" opt; do
 done
 
 full_run() {
-  aws_notify "Starting CopperheadOS Build ($OFFICIAL_DATE)"
-  setup_env
-  check_chrome
-  fetch_chos
-  setup_vendor
-  aws_import_keys
-  patch_chos
-  build_chos
-  aws_release
+  if ! ${LOCAL_BUILD}; then
+    aws_stream_logs
+    aws_instance_info
+  fi
+  aws_start_build
+  aws_notify "Starting CopperheadOS Build ($OFFICIAL_DATE) on ${LAUNCH_PATH} instance" started
+  if ! ${LOCAL_BUILD}; then
+    aws_tag_volumes
+    aws_spot_price_metric
+    aws_watch_spot_interruption
+  fi
+  run_stage setup_env
+  run_stage check_chrome
+  run_stage fetch_chos
+  run_stage setup_vendor
+  run_stage aws_import_keys
+  run_stage patch_chos
+  run_stage build_chos
+  run_stage aws_release
+}
+
+# call with argument: name of the stage function to run
+run_stage() {
+  BUILD_STAGE="$1"
+  stage_start=$(date +%s)
+  aws_event stage_started
+  "$1"
+  aws_event stage_finished "" $(( $(date +%s) - stage_start ))
+  aws_metric StageDuration $(( $(date +%s) - stage_start )) Seconds "Stage=$1"
+  BUILD_STAGE=''
 }
 
 setup_env() {
@@ -78,9 +164,15 @@ fetch_chos() {
   verify_manifest
   pushd "${CHOS_DIR}"
   sed -i '/platform_external_chromium/d' .repo/manifest.xml || true
-  for i in {1..10}; do
+  for i in $(seq ${REPO_SYNC_ATTEMPTS}); do
     repo sync --jobs 32 && break
+    REPO_SYNC_RETRIES=$i
   done
+  aws_metric RepoSyncRetries "${REPO_SYNC_RETRIES}" Count
+  if [ "${REPO_SYNC_RETRIES}" -ge "${REPO_SYNC_ATTEMPTS}" ]; then
+    echo "repo sync failed ${REPO_SYNC_ATTEMPTS} times, giving up"
+    return 1
+  fi
   verify_source
 }
 
@@ -92,7 +184,7 @@ patch_chos() {
 
 check_chrome() {
   chrome_external_setup
-  current=$(aws s3 cp "s3://${AWS_RELEASE_BUCKET}/chromium/revision" - || true)
+  current=$(storage_cp "${RELEASE_STORAGE}/chromium/revision" - || true)
   echo "Chromium current: $current"
 
   mkdir -p $HOME/chromium
@@ -136,7 +228,7 @@ EOF
 }
 
 copy_chrome() {
-  aws s3 cp "s3://${AWS_RELEASE_BUCKET}/chromium/MonochromePublic.apk" ${CHOS_DIR}/external/chromium/prebuilt/arm64/
+  storage_cp "${RELEASE_STORAGE}/chromium/MonochromePublic.apk" ${CHOS_DIR}/external/chromium/prebuilt/arm64/
 }
 
 build_chrome() {
@@ -159,8 +251,8 @@ build_chrome() {
   ninja -C out/Default/ monochrome_public_apk
 
   cp out/Default/apks/MonochromePublic.apk ${CHOS_DIR}/external/chromium/prebuilt/arm64/
-  aws s3 cp "${CHOS_DIR}/external/chromium/prebuilt/arm64/MonochromePublic.apk" "s3://${AWS_RELEASE_BUCKET}/chromium/MonochromePublic.apk" --acl public-read
-  echo "${CHROMIUM_REVISION}" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/chromium/revision" --acl public-read
+  storage_cp --public "${CHOS_DIR}/external/chromium/prebuilt/arm64/MonochromePublic.apk" "${RELEASE_STORAGE}/chromium/MonochromePublic.apk"
+  echo "${CHROMIUM_REVISION}" | storage_cp --public - "${RELEASE_STORAGE}/chromium/revision"
 
   rm -rf $HOME/chromium
 }
@@ -169,9 +261,12 @@ build_chos() {
   pushd "$CHOS_DIR"
   source "${CHOS_DIR}/script/copperhead.sh"
 
+  export USE_CCACHE=1
+  ccache --zero-stats || true
   choosecombo $BUILD_TARGET
   make -j $(nproc) target-files-package
   make -j $(nproc) brillo_update_payload
+  aws_ccache_metric
 
   "${CHOS_DIR}/script/release.sh" "$DEVICE"
 }
@@ -265,11 +360,11 @@ patch_priv_ext() {
 }
 
 aws_import_keys() {
-  if [ "$(aws s3 ls "s3://${AWS_KEYS_BUCKET}/${DEVICE}" | wc -l)" == '0' ]; then
+  if [ "$(storage_ls "${KEYS_STORAGE}/${DEVICE}" | wc -l)" == '0' ]; then
     aws_gen_keys
   else
     mkdir "${CHOS_DIR}/keys"
-    aws s3 sync "s3://${AWS_KEYS_BUCKET}" "${CHOS_DIR}/keys"
+    storage_sync "${KEYS_STORAGE}" "${CHOS_DIR}/keys"
     ln --verbose --symbolic "${CHOS_DIR}/keys/${DEVICE}/verity_user.der.x509" "${CHOS_DIR}/kernel/google/marlin/verity_user.der.x509"
   fi
 }
@@ -310,10 +405,10 @@ ENDDEBUGFSPATCH
   {
     ("${CHOS_DIR}/vendor/android-prepare-vendor/execute-all.sh" --device "${DEVICE}" --buildID "${OFFICIAL_VERSION}" --output "${CHOS_DIR}/vendor/android-prepare-vendor") && vendor_version="$OFFICIAL_VERSION"
   } || {
-    read -ra vendor_version <<< "$(wget -O - "${UNOFFICIAL_RELEASE_URL}/${DEVICE}-vendor")"
+    read -ra vendor_version <<< "$(storage_cp "${RELEASE_STORAGE}/${DEVICE}-vendor" -)"
     ("${CHOS_DIR}/vendor/android-prepare-vendor/execute-all.sh" --device "${DEVICE}" --buildID "${vendor_version}" --output "${CHOS_DIR}/vendor/android-prepare-vendor")
   }
-  aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/${DEVICE}-vendor" --acl public-read <<< "${vendor_version}" || true
+  storage_cp --public - "${RELEASE_STORAGE}/${DEVICE}-vendor" <<< "${vendor_version}" || true
 
   mkdir --parents "${CHOS_DIR}/vendor/google_devices" || true
   rm --recursive --force "${CHOS_DIR}/vendor/google_devices/$DEVICE" || true
@@ -337,26 +432,27 @@ aws_release() {
   build_date="$(< build_number.txt)"
   build_timestamp="$(unzip -p "release-${DEVICE}-${build_date}/${DEVICE}-ota_update-${build_date}.zip" META-INF/com/android/metadata | grep 'post-timestamp' | cut --delimiter "=" --fields 2)"
 
-  read -r old_metadata <<< "$(wget -O - "${UNOFFICIAL_RELEASE_URL}/${DEVICE}-stable")"
+  read -r old_metadata <<< "$(storage_cp "${RELEASE_STORAGE}/${DEVICE}-stable" - || true)"
   old_date="$(cut -d ' ' -f 1 <<< "${old_metadata}")"
+  OTA_SIZE=$(stat --format=%s "${CHOS_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-ota_update-${build_date}.zip" || echo 0)
   (
-  aws s3 cp "${CHOS_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-ota_update-${build_date}.zip" "s3://${AWS_RELEASE_BUCKET}" --acl public-read &&
-  echo "${build_date} ${build_timestamp} ${OFFICIAL_VERSION}" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/${RELEASE_CHANNEL}" --acl public-read &&
-  echo "${OFFICIAL_TIMESTAMP}" | aws s3 cp - "s3://${AWS_RELEASE_BUCKET}/${RELEASE_CHANNEL}-true-timestamp" --acl public-read
-  ) && ( aws s3 rm "s3://${AWS_RELEASE_BUCKET}/${DEVICE}-ota_update-${old_date}.zip" || true )
+  storage_cp --public "${CHOS_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-ota_update-${build_date}.zip" "${RELEASE_STORAGE}/" &&
+  echo "${build_date} ${build_timestamp} ${OFFICIAL_VERSION}" | storage_cp --public - "${RELEASE_STORAGE}/${RELEASE_CHANNEL}" &&
+  echo "${OFFICIAL_TIMESTAMP}" | storage_cp --public - "${RELEASE_STORAGE}/${RELEASE_CHANNEL}-true-timestamp"
+  ) && ( storage_rm "${RELEASE_STORAGE}/${DEVICE}-ota_update-${old_date}.zip" || true )
 
-  if [ "$(aws s3 ls "s3://${AWS_RELEASE_BUCKET}/${DEVICE}-factory-latest.tar.xz" | wc -l)" == '0' ]; then
-    aws s3 cp "${CHOS_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-factory-${build_date}.tar.xz" "s3://${AWS_RELEASE_BUCKET}/${DEVICE}-factory-latest.tar.xz" --acl public-read
+  if [ "$(storage_ls "${RELEASE_STORAGE}/${DEVICE}-factory-latest.tar.xz" | wc -l)" == '0' ]; then
+    storage_cp --public "${CHOS_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-factory-${build_date}.tar.xz" "${RELEASE_STORAGE}/${DEVICE}-factory-latest.tar.xz"
   fi
 
-  if [ "$(aws s3 ls "s3://${AWS_RELEASE_BUCKET}/${DEVICE}-target" | wc -l)" != '0' ]; then
+  if [ "$(storage_ls "${RELEASE_STORAGE}/${DEVICE}-target" | wc -l)" != '0' ]; then
     aws_gen_deltas
   fi
-  aws s3 cp "${CHOS_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-target_files-${build_date}.zip" "s3://${AWS_RELEASE_BUCKET}/${DEVICE}-target/${DEVICE}-target-files-${build_date}.zip" --acl public-read
+  storage_cp --public "${CHOS_DIR}/out/release-${DEVICE}-${build_date}/${DEVICE}-target_files-${build_date}.zip" "${RELEASE_STORAGE}/${DEVICE}-target/${DEVICE}-target-files-${build_date}.zip"
 }
 
 aws_gen_deltas() {
-  aws s3 sync "s3://${AWS_RELEASE_BUCKET}/${DEVICE}-target" "${CHOS_DIR}/${DEVICE}-target"
+  storage_sync "${RELEASE_STORAGE}/${DEVICE}-target" "${CHOS_DIR}/${DEVICE}-target"
   pushd "${CHOS_DIR}/out"
   current_date="$(< build_number.txt)"
   pushd "${CHOS_DIR}/${DEVICE}-target"
@@ -370,25 +466,304 @@ aws_gen_deltas() {
     popd
   done
   for incremental in ${CHOS_DIR}/out/release-${DEVICE}-${current_date}/${DEVICE}-incremental-*-*.zip ; do
-    ( aws s3 cp "$incremental" "s3://${AWS_RELEASE_BUCKET}/" --acl public-read && aws s3 rm "s3://${AWS_RELEASE_BUCKET}/${DEVICE}-target/${DEVICE}-target-files-${old_date}.zip") || true
+    INCREMENTAL_SIZE=$(( INCREMENTAL_SIZE + $(stat --format=%s "$incremental" || echo 0) ))
+    ( storage_cp --public "$incremental" "${RELEASE_STORAGE}/" && storage_rm "${RELEASE_STORAGE}/${DEVICE}-target/${DEVICE}-target-files-${old_date}.zip") || true
   done
 }
 
+<% if .LocalBuildDir %>
+# call with arguments: [--public] source destination, either can be - for stdin/stdout
+storage_cp() {
+  if [ "$1" == '--public' ]; then
+    shift
+  fi
+  if [ "$2" == '-' ]; then
+    cat "$1"
+    return
+  fi
+  dest="$2"
+  if [ -d "${dest}" ] || [[ "${dest}" == */ ]]; then
+    dest="${dest%/}/$(basename "$1")"
+  fi
+  mkdir --parents "$(dirname "${dest}")"
+  if [ "$1" == '-' ]; then
+    cat > "${dest}"
+  else
+    cp "$1" "${dest}"
+  fi
+}
+
+# call with argument: prefix, prints a line for every file or directory starting with it
+storage_ls() {
+  ls --directory "$1"* 2>/dev/null || true
+}
+
+storage_sync() {
+  mkdir --parents "$2"
+  if [ -d "$1" ]; then
+    cp --recursive --no-target-directory "$1" "$2"
+  fi
+}
+
+storage_rm() {
+  rm --force "$1"
+}
+<% else %>
+# call with arguments: [--public] source destination, either can be - for stdin/stdout
+storage_cp() {
+  acl=()
+  if [ "$1" == '--public' ]; then
+    acl=(--acl public-read)
+    shift
+  fi
+  "${S3_ENDPOINT_ENV[@]}" aws s3 cp "${S3_ENDPOINT_ARGS[@]}" "$1" "$2" "${acl[@]}"
+}
+
+# call with argument: prefix, prints a line for every object or common prefix starting with it
+storage_ls() {
+  "${S3_ENDPOINT_ENV[@]}" aws s3 ls "${S3_ENDPOINT_ARGS[@]}" "$1"
+}
+
+storage_sync() {
+  "${S3_ENDPOINT_ENV[@]}" aws s3 sync "${S3_ENDPOINT_ARGS[@]}" "$1" "$2"
+}
+
+storage_rm() {
+  "${S3_ENDPOINT_ENV[@]}" aws s3 rm "${S3_ENDPOINT_ARGS[@]}" "$1"
+}
+<% end %>
+# spot fleets can only tag instances, so tag attached volumes from the instance itself
+aws_tag_volumes() {
+  instance_id=$(curl -s http://169.254.169.254/latest/meta-data/instance-id)
+  volumes=$(aws ec2 describe-volumes --region <% .Region %> --filters "Name=attachment.instance-id,Values=${instance_id}" --query 'Volumes[].VolumeId' --output text || true)
+  aws ec2 create-tags --region <% .Region %> --resources ${volumes} \
+    --tags 'Key=chos:stack,Value=<% .Name %>' 'Key=chos:device,Value=<% .Device %>' 'Key=chos:version,Value=<% .Version %>' || true
+}
+
+# call with arguments: metric name, value, unit, optional extra dimension (e.g. Stage=build_chos)
+aws_metric() {
+  if ${LOCAL_BUILD}; then
+    return 0
+  fi
+  aws cloudwatch put-metric-data --region <% .Region %> --namespace CopperheadOS --metric-name "$1" --value "$2" --unit "$3" \
+    --dimensions "Stack=<% .Name %>,Device=${DEVICE}${4:+,$4}" || true
+}
+
+aws_instance_info() {
+  INSTANCE_TYPE=$(curl -s http://169.254.169.254/latest/meta-data/instance-type || true)
+  if [ "$(curl -s http://169.254.169.254/latest/meta-data/instance-life-cycle || true)" != 'spot' ]; then
+    return 0
+  fi
+  zone=$(curl -s http://169.254.169.254/latest/meta-data/placement/availability-zone || true)
+  price=$(aws ec2 describe-spot-price-history --region <% .Region %> --instance-types "${INSTANCE_TYPE}" --availability-zone "${zone}" \
+    --product-descriptions Linux/UNIX --start-time "$(date -u +%Y-%m-%dT%H:%M:%SZ)" --query 'SpotPriceHistory[0].SpotPrice' --output text || true)
+  if [ -n "${price}" ] && [ "${price}" != 'None' ]; then
+    SPOT_PRICE="${price}"
+  fi
+}
+
+aws_spot_price_metric() {
+  if [ -n "${SPOT_PRICE}" ]; then
+    aws_metric SpotPrice "${SPOT_PRICE}" None
+  fi
+}
+
+aws_ccache_metric() {
+  stats=$(ccache --show-stats || true)
+  hits=$(awk '/^cache hit/ {sum += $NF} END {print sum + 0}' <<< "${stats}")
+  misses=$(awk '/^cache miss/ {sum += $NF} END {print sum + 0}' <<< "${stats}")
+  if [ $(( hits + misses )) -gt 0 ]; then
+    aws_metric CcacheHitRate "$(awk -v hits="${hits}" -v misses="${misses}" 'BEGIN {printf "%.2f", hits * 100 / (hits + misses)}')" Percent
+  fi
+}
+
+# call with arguments: message, optional build event (started|success|failed)
+# subscribers get the plain message, the notifier lambda gets the build details as json
 aws_notify() {
   message="$1"
+  if ${LOCAL_BUILD}; then
+    echo "NOTIFICATION: ${message}"
+    return 0
+  fi
+  payload=$(jq --null-input --compact-output --arg message "${message}" --arg event "${2:-info}" --arg device "${DEVICE}" \
+    --arg build_id "${BUILD_ID}" --arg official_date "${OFFICIAL_DATE}" --arg launch_path "${LAUNCH_PATH}" --arg stage "${BUILD_STAGE}" \
+    --argjson duration_seconds $(( $(date +%s) - BUILD_ID )) --argjson ota_size_bytes "${OTA_SIZE}" \
+    --arg failure_reason "${FAILURE_REASON}" --arg failure_lines "${FAILURE_LINES}" --arg log_url "${LOG_URL}" --arg log_command "${LOG_COMMAND}" \
+    '{default: $message, lambda: ({event: $event, message: $message, device: $device, build_id: $build_id, official_date: $official_date, launch_path: $launch_path, stage: $stage, duration_seconds: $duration_seconds, ota_size_bytes: $ota_size_bytes, failure_reason: $failure_reason, failure_lines: $failure_lines, log_url: $log_url, log_command: $log_command} | tojson)}') &&
+  aws sns publish --region <% .Region %> --topic-arn "$AWS_SNS_ARN" --message-structure json --message "$payload" ||
   aws sns publish --region <% .Region %> --topic-arn "$AWS_SNS_ARN" --message "$message" || true
 }
 
+# sets FAILURE_REASON and FAILURE_LINES from the build log and the stage the build stopped in
+classify_failure() {
+  gpg_failure='BADSIG|ERRSIG|NO_PUBKEY|EXPKEYSIG|REVKEYSIG|no signature found|could not verify'
+  compile_failure='FAILED: |error: |make: \*\*\*|ninja: build stopped'
+  upload_failure='upload failed:|An error occurred'
+  patterns=''
+  if [ -f "${SPOT_INTERRUPTION_MARKER}" ]; then
+    FAILURE_REASON='spot interruption'
+  elif grep --quiet 'No space left on device' "${BUILD_LOG}"; then
+    FAILURE_REASON='out of disk'
+    patterns='No space left on device'
+  elif [ "${BUILD_STAGE}" == 'fetch_chos' ] && [ "${REPO_SYNC_RETRIES}" -ge "${REPO_SYNC_ATTEMPTS}" ]; then
+    FAILURE_REASON="repo sync failed ${REPO_SYNC_ATTEMPTS} times"
+    patterns='^error|^fatal|repo sync failed'
+  elif [ "${BUILD_STAGE}" == 'fetch_chos' ] && grep --quiet --extended-regexp "${gpg_failure}" "${BUILD_LOG}"; then
+    FAILURE_REASON='gpg tag verification failed'
+    patterns="${gpg_failure}"
+  elif [ "${BUILD_STAGE}" == 'setup_vendor' ]; then
+    FAILURE_REASON='android-prepare-vendor failed'
+    patterns='\[-\]|[Ee]rror'
+  elif [ "${BUILD_STAGE}" == 'build_chos' ] || [ "${BUILD_STAGE}" == 'check_chrome' ]; then
+    FAILURE_REASON='compile error'
+    patterns="${compile_failure}"
+  elif [ "${BUILD_STAGE}" == 'aws_release' ] || grep --quiet 'upload failed:' "${BUILD_LOG}"; then
+    FAILURE_REASON='upload failed'
+    patterns="${upload_failure}"
+  else
+    FAILURE_REASON="failed in stage ${BUILD_STAGE:-unknown}"
+  fi
+
+  if [ -n "${patterns}" ]; then
+    FAILURE_LINES=$(grep --extended-regexp "${patterns}" "${BUILD_LOG}" | tail -n 5 | cut --characters 1-300 || true)
+  fi
+  if [ -z "${FAILURE_LINES}" ]; then
+    FAILURE_LINES=$(tail -n 10 "${BUILD_LOG}" | cut --characters 1-300)
+  fi
+}
+
+# call with argument: exit status of the build
+aws_report_failure() {
+  classify_failure
+  # the log stays private, presigned urls would stop working with the temporary credentials of the instance
+  LOG_URL="${LOGS_STORAGE}/${DEVICE}/${BUILD_ID}"
+  if ! ${LOCAL_BUILD}; then
+    LOG_COMMAND="copperheados-stack logs --region <% .Region %> --name <% .Name %> --device ${DEVICE} --build ${BUILD_ID}"
+  fi
+  aws_metric BuildFailure 1 Count
+  aws_event build_failed "${FAILURE_REASON} (exit status $1): $(tail -n 1 <<< "${FAILURE_LINES}")"
+  aws_notify "$(printf 'CopperheadOS Build FAILED (%s) on %s instance: %s\n\n%s\n\nFull log: %s\n%s' \
+    "${OFFICIAL_DATE}" "${LAUNCH_PATH}" "${FAILURE_REASON}" "${FAILURE_LINES}" "${LOG_URL}" "${LOG_COMMAND}")" failed
+}
+
+# spot instances get a two minute warning before they are reclaimed, report the build as failed while still possible
+aws_watch_spot_interruption() {
+  if [ "$(curl -s http://169.254.169.254/latest/meta-data/instance-life-cycle)" != 'spot' ]; then
+    return 0
+  fi
+  (
+    while ! curl --silent --fail http://169.254.169.254/latest/meta-data/spot/instance-action > /dev/null; do
+      sleep 5
+    done
+    touch "${SPOT_INTERRUPTION_MARKER}"
+    echo "Spot instance is being reclaimed: $(curl --silent http://169.254.169.254/latest/meta-data/spot/instance-action)"
+    aws_put_log_events || true
+    storage_cp "${BUILD_LOG}" "${LOGS_STORAGE}/${DEVICE}/${BUILD_ID}" || true
+    aws_report_failure 143
+    aws_release_build_lock
+  ) &
+  SPOT_WATCH_PID=$!
+}
+
+# the build checker doesn't start another build until the lock is released or
+# its lease expired, only the build it was taken for releases it
+aws_release_build_lock() {
+  if ${LOCAL_BUILD} || [ -z "${BUILD_LOCK_TOKEN}" ]; then
+    return 0
+  fi
+  aws dynamodb delete-item --region <% .Region %> --table-name "${AWS_LOCK_TABLE}" --key "{\"LockID\":{\"S\":\"${BUILD_LOCK_ID}\"}}" \
+    --condition-expression '#token = :token' --expression-attribute-names '{"#token":"Token"}' \
+    --expression-attribute-values "{\":token\":{\"S\":\"${BUILD_LOCK_TOKEN}\"}}" || true
+}
+
 aws_logging() {
   df -h
   du -chs "${CHOS_DIR}"
   uptime
-  aws s3 cp /var/log/cloud-init-output.log "s3://${AWS_LOGS_BUCKET}/${DEVICE}/$(date +%s)"
+  aws_stop_log_stream
+  storage_cp "${BUILD_LOG}" "${LOGS_STORAGE}/${DEVICE}/${BUILD_ID}"
+}
+
+aws_stream_logs() {
+  mkdir --parents "${LOG_STREAM_STATE}"
+  aws logs create-log-stream --region <% .Region %> --log-group-name "${AWS_LOG_GROUP}" --log-stream-name "${DEVICE}/${BUILD_ID}" || return 0
+  (
+    while true; do
+      aws_put_log_events || true
+      sleep 10
+    done
+  ) &
+  LOG_STREAM_PID=$!
+}
+
+aws_stop_log_stream() {
+  if [ -n "${LOG_STREAM_PID}" ]; then
+    kill "${LOG_STREAM_PID}" || true
+    wait "${LOG_STREAM_PID}" 2>/dev/null || true
+    # ship whatever was logged since the last batch
+    aws_put_log_events || true
+  fi
+}
+
+# sends the lines added to the build log since the last call, offset and sequence token are kept in ${LOG_STREAM_STATE}
+aws_put_log_events() {
+  offset=$(cat "${LOG_STREAM_STATE}/offset" 2>/dev/null || echo 0)
+  chunk="${LOG_STREAM_STATE}/chunk"
+  # put-log-events takes at most 10000 events of up to 256 KiB each and 1 MiB in total
+  tail -c +$((offset + 1)) "${BUILD_LOG}" | head -c 524288 | head -n 10000 > "${chunk}"
+  size=$(wc -c < "${chunk}")
+  if [ "${size}" -eq 0 ]; then
+    return 0
+  fi
+  # hold back a trailing partial line until it is complete
+  if [ -n "$(tail -c 1 "${chunk}")" ]; then
+    partial=$(tail -n 1 "${chunk}" | wc -c)
+    if [ "${partial}" -lt "${size}" ]; then
+      truncate --size=-"${partial}" "${chunk}"
+      size=$((size - partial))
+    fi
+  fi
+
+  # longer lines are truncated, the full log is archived in the logs bucket
+  cut --bytes=-262000 "${chunk}" | jq --raw-input --slurp --arg timestamp "$(date +%s%3N)" \
+    'split("\n") | map(select(length > 0)) | map({timestamp: ($timestamp | tonumber), message: .})' \
+    > "${LOG_STREAM_STATE}/events.json"
+  if [ "$(jq length "${LOG_STREAM_STATE}/events.json")" != '0' ]; then
+    token=$(cat "${LOG_STREAM_STATE}/token" 2>/dev/null || true)
+    if ! token=$(aws logs put-log-events --region <% .Region %> --log-group-name "${AWS_LOG_GROUP}" --log-stream-name "${DEVICE}/${BUILD_ID}" \
+        --log-events "file://${LOG_STREAM_STATE}/events.json" ${token:+--sequence-token "${token}"} --query nextSequenceToken --output text); then
+      # refresh the sequence token and retry with the same lines next time
+      aws logs describe-log-streams --region <% .Region %> --log-group-name "${AWS_LOG_GROUP}" --log-stream-name-prefix "${DEVICE}/${BUILD_ID}" \
+        --query 'logStreams[0].uploadSequenceToken' --output text | grep -v '^None$' > "${LOG_STREAM_STATE}/token" || true
+      return 1
+    fi
+    echo "${token}" > "${LOG_STREAM_STATE}/token"
+  fi
+  echo $((offset + size)) > "${LOG_STREAM_STATE}/offset"
+}
+
+aws_start_build() {
+  echo "${BUILD_ID}" | storage_cp - "${EVENTS_STORAGE}/current" || true
+  aws_event build_started
+}
+
+# call with arguments: event type, optional error message, optional stage duration in seconds
+aws_event() {
+  event="$1"
+  error="$(tr -d '\000-\037' <<< "${2:-}")"
+  error="${error//\\/\\\\}"
+  error="${error//\"/\\\"}"
+  read -r disk_used disk_available <<< "$(df --output=used,avail --block-size=G / | tail -n 1 | tr -d G)"
+  EVENT_SEQ=$((EVENT_SEQ + 1))
+  printf '{"build_id":"%s","device":"%s","event":"%s","stage":"%s","timestamp":"%s","elapsed_seconds":%d,"stage_seconds":%d,"disk_used_gb":%d,"disk_available_gb":%d,"launch_path":"%s","instance_type":"%s","spot_price":"%s","official_date":"%s","error":"%s"}\n' \
+    "${BUILD_ID}" "${DEVICE}" "${event}" "${BUILD_STAGE}" "$(date -u +%Y-%m-%dT%H:%M:%SZ)" $(( $(date +%s) - BUILD_ID )) "${3:-0}" \
+    "${disk_used:-0}" "${disk_available:-0}" "${LAUNCH_PATH}" "${INSTANCE_TYPE}" "${SPOT_PRICE}" "${OFFICIAL_DATE}" "${error}" |
+    storage_cp - "${EVENTS_STORAGE}/${BUILD_ID}/events/$(printf '%04d' ${EVENT_SEQ})-${event}.json" || true
 }
 
 aws_gen_keys() {
   gen_keys
-  aws s3 sync "${CHOS_DIR}/keys" "s3://${AWS_KEYS_BUCKET}"
+  storage_sync "${CHOS_DIR}/keys" "${KEYS_STORAGE}"
 }
 
 gen_keys() {
@@ -428,12 +803,23 @@ gen_verity_key() {
 
 cleanup() {
   rv=$?
+  if [ -n "${SPOT_WATCH_PID}" ]; then
+    kill "${SPOT_WATCH_PID}" || true
+  fi
   aws_logging
-  if [ $rv -ne 0 ]; then
-    aws_notify "CopperheadOS Build FAILED ($OFFICIAL_DATE)"
+  aws_metric BuildDuration $(( $(date +%s) - BUILD_ID )) Seconds
+  if [ -f "${SPOT_INTERRUPTION_MARKER}" ]; then
+    echo "Build failure already reported after spot interruption"
+  elif [ $rv -ne 0 ]; then
+    aws_report_failure $rv
   else
-    aws_notify "CopperheadOS Build SUCCESS ($OFFICIAL_DATE)"
+    aws_metric BuildSuccess 1 Count
+    aws_metric OTASize "${OTA_SIZE}" Bytes
+    aws_metric IncrementalSize "${INCREMENTAL_SIZE}" Bytes
+    aws_event build_finished
+    aws_notify "CopperheadOS Build SUCCESS ($OFFICIAL_DATE) on ${LAUNCH_PATH} instance" success
   fi
+  aws_release_build_lock
   if ${PREVENT_SHUTDOWN}; then
     echo "Skipping shutdown"
   else
@@ -441,6 +827,10 @@ cleanup() {
   fi
 }
 
+<% if .LocalBuildDir %>
+# there is no cloud-init log on local builds, keep a copy of all output instead
+exec > >(tee "${BUILD_LOG}") 2>&1
+<% end %>
 trap cleanup 0
 
 set -e
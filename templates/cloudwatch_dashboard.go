@@ -0,0 +1,144 @@
+package templates
+
+const CloudWatchDashboardTemplate = `{
+  "widgets": [
+    {
+      "type": "metric",
+      "x": 0,
+      "y": 0,
+      "width": 12,
+      "height": 6,
+      "properties": {
+        "title": "Builds",
+        "region": "<% .Region %>",
+        "stat": "Sum",
+        "period": 86400,
+        "metrics": [
+          ["CopperheadOS", "BuildSuccess", "Stack", "<% .Name %>", "Device", "<% .Device %>"],
+          ["CopperheadOS", "BuildFailure", "Stack", "<% .Name %>", "Device", "<% .Device %>"]
+        ]
+      }
+    },
+    {
+      "type": "metric",
+      "x": 12,
+      "y": 0,
+      "width": 12,
+      "height": 6,
+      "properties": {
+        "title": "Build duration (seconds)",
+        "region": "<% .Region %>",
+        "stat": "Maximum",
+        "period": 86400,
+        "metrics": [
+          ["CopperheadOS", "BuildDuration", "Stack", "<% .Name %>", "Device", "<% .Device %>"]
+        ]
+      }
+    },
+    {
+      "type": "metric",
+      "x": 0,
+      "y": 6,
+      "width": 12,
+      "height": 6,
+      "properties": {
+        "title": "Stage duration (seconds)",
+        "region": "<% .Region %>",
+        "stat": "Maximum",
+        "period": 86400,
+        "metrics": [
+          ["CopperheadOS", "StageDuration", "Stack", "<% .Name %>", "Device", "<% .Device %>", "Stage", "setup_env"],
+          ["CopperheadOS", "StageDuration", "Stack", "<% .Name %>", "Device", "<% .Device %>", "Stage", "check_chrome"],
+          ["CopperheadOS", "StageDuration", "Stack", "<% .Name %>", "Device", "<% .Device %>", "Stage", "fetch_chos"],
+          ["CopperheadOS", "StageDuration", "Stack", "<% .Name %>", "Device", "<% .Device %>", "Stage", "setup_vendor"],
+          ["CopperheadOS", "StageDuration", "Stack", "<% .Name %>", "Device", "<% .Device %>", "Stage", "aws_import_keys"],
+          ["CopperheadOS", "StageDuration", "Stack", "<% .Name %>", "Device", "<% .Device %>", "Stage", "patch_chos"],
+          ["CopperheadOS", "StageDuration", "Stack", "<% .Name %>", "Device", "<% .Device %>", "Stage", "build_chos"],
+          ["CopperheadOS", "StageDuration", "Stack", "<% .Name %>", "Device", "<% .Device %>", "Stage", "aws_release"]
+        ]
+      }
+    },
+    {
+      "type": "metric",
+      "x": 12,
+      "y": 6,
+      "width": 12,
+      "height": 6,
+      "properties": {
+        "title": "Release sizes (bytes)",
+        "region": "<% .Region %>",
+        "stat": "Maximum",
+        "period": 86400,
+        "metrics": [
+          ["CopperheadOS", "OTASize", "Stack", "<% .Name %>", "Device", "<% .Device %>"],
+          ["CopperheadOS", "IncrementalSize", "Stack", "<% .Name %>", "Device", "<% .Device %>"]
+        ]
+      }
+    },
+    {
+      "type": "metric",
+      "x": 0,
+      "y": 12,
+      "width": 12,
+      "height": 6,
+      "properties": {
+        "title": "repo sync retries",
+        "region": "<% .Region %>",
+        "stat": "Maximum",
+        "period": 86400,
+        "metrics": [
+          ["CopperheadOS", "RepoSyncRetries", "Stack", "<% .Name %>", "Device", "<% .Device %>"]
+        ]
+      }
+    },
+    {
+      "type": "metric",
+      "x": 12,
+      "y": 12,
+      "width": 12,
+      "height": 6,
+      "properties": {
+        "title": "ccache hit rate (%)",
+        "region": "<% .Region %>",
+        "stat": "Maximum",
+        "period": 86400,
+        "metrics": [
+          ["CopperheadOS", "CcacheHitRate", "Stack", "<% .Name %>", "Device", "<% .Device %>"]
+        ]
+      }
+    },
+    {
+      "type": "metric",
+      "x": 0,
+      "y": 18,
+      "width": 12,
+      "height": 6,
+      "properties": {
+        "title": "Spot price paid ($/hour)",
+        "region": "<% .Region %>",
+        "stat": "Maximum",
+        "period": 86400,
+        "metrics": [
+          ["CopperheadOS", "SpotPrice", "Stack", "<% .Name %>", "Device", "<% .Device %>"]
+        ]
+      }
+    },
+    {
+      "type": "metric",
+      "x": 12,
+      "y": 18,
+      "width": 12,
+      "height": 6,
+      "properties": {
+        "title": "Build checker Lambda errors",
+        "region": "<% .Region %>",
+        "stat": "Sum",
+        "period": 3600,
+        "metrics": [
+          ["AWS/Lambda", "Errors", "FunctionName", "<% .Name %>-build"]
+        ]
+      }
+    }
+  ]
+}
+`
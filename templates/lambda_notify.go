@@ -0,0 +1,110 @@
+package templates
+
+const LambdaNotifyFunctionTemplate = `
+#!/usr/bin/env python3
+import boto3
+import json
+import time
+from urllib.parse import quote, urlsplit, urlunsplit
+from urllib.request import Request, urlopen
+
+STACK_NAME = '<% .Name %>'
+WEBHOOKS_PATH = '/<% .Name %>/webhooks/'
+WEBHOOK_TIMEOUT_SECONDS = 10
+
+def lambda_handler(event, context):
+    # invoked directly by 'copperheados-stack notify test'
+    if 'test' in event:
+        build = {
+            'event': 'test',
+            'message': 'Test notification from CopperheadOS stack {0}'.format(STACK_NAME),
+            'device': '',
+        }
+        return post_all(build, event.get('webhook'))
+
+    for record in event['Records']:
+        post_all(parse_message(record['Sns']['Message']))
+
+def parse_message(message):
+    # builds publish json, anything else (e.g. messages of the build checker) is plain text
+    try:
+        build = json.loads(message)
+        if isinstance(build, dict) and 'event' in build:
+            return build
+        if isinstance(build, dict) and 'AlarmName' in build:
+            return {'event': 'alarm', 'message': "{0}: {1}".format(build.get('AlarmDescription') or build['AlarmName'], build.get('NewStateReason'))}
+    except ValueError:
+        pass
+    return {'event': 'info', 'message': message}
+
+def post_all(build, only=None):
+    results = {}
+    for webhook_id, webhook in webhooks().items():
+        if only and webhook_id != only:
+            continue
+        try:
+            post(webhook, build)
+            results[webhook_id] = 'ok'
+        except Exception as e:
+            print("webhook {0} failed: {1}".format(webhook_id, e))
+            results[webhook_id] = str(e)
+    print(results)
+    return results
+
+def webhooks():
+    client = boto3.client('ssm')
+    found = {}
+    paginator = client.get_paginator('get_parameters_by_path')
+    for page in paginator.paginate(Path=WEBHOOKS_PATH, WithDecryption=True):
+        for parameter in page['Parameters']:
+            found[parameter['Name'][len(WEBHOOKS_PATH):]] = json.loads(parameter['Value'])
+    return found
+
+def post(webhook, build):
+    kind = webhook['type']
+    url = webhook['url']
+    method = 'POST'
+    if kind == 'slack':
+        body = {'text': format_text(build)}
+    elif kind == 'matrix':
+        # url is the room send endpoint, e.g. https://matrix.org/_matrix/client/r0/rooms/<room id>/send/m.room.message?access_token=<token>
+        parts = urlsplit(url)
+        url = urlunsplit((parts.scheme, parts.netloc, parts.path.rstrip('/') + '/' + quote(str(time.time())), parts.query, parts.fragment))
+        method = 'PUT'
+        body = {'msgtype': 'm.text', 'body': format_text(build)}
+    else:
+        body = dict(build, stack=STACK_NAME, text=format_text(build))
+
+    request = Request(url, data=json.dumps(body).encode('utf-8'), method=method, headers={'Content-Type': 'application/json'})
+    urlopen(request, timeout=WEBHOOK_TIMEOUT_SECONDS).read()
+
+def format_text(build):
+    event = build['event']
+    if event not in ('started', 'success', 'failed'):
+        return build['message']
+
+    text = "CopperheadOS build of {0} ({1})".format(build.get('device'), build.get('official_date'))
+    if event == 'started':
+        text += " started on {0} instance".format(build.get('launch_path'))
+    elif event == 'success':
+        text += " SUCCESS after {0}".format(format_duration(build.get('duration_seconds', 0)))
+        if build.get('ota_size_bytes'):
+            text += ", OTA update is {0:.2f} GB".format(build['ota_size_bytes'] / 1024 ** 3)
+    else:
+        text += " FAILED after {0}".format(format_duration(build.get('duration_seconds', 0)))
+        if build.get('stage'):
+            text += " in stage {0}".format(build['stage'])
+        if build.get('failure_reason'):
+            text += ": {0}".format(build['failure_reason'])
+        if build.get('failure_lines'):
+            text += "\n\n{0}".format(build['failure_lines'])
+        if build.get('log_url'):
+            text += "\n\nFull log: {0}".format(build['log_url'])
+        if build.get('log_command'):
+            text += "\n{0}".format(build['log_command'])
+    return text
+
+def format_duration(seconds):
+    hours, remainder = divmod(int(seconds), 3600)
+    return "{0}h{1:02d}m".format(hours, remainder // 60)
+`
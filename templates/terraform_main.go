@@ -6,9 +6,15 @@ const TerraformTemplate = `
 ######################
 terraform {
 	backend "s3" {
-		bucket = "<% .Name %>"
-		key    = "terraform.state"
-		region = "<% .Region %>"
+		bucket         = "<% .Name %>"
+		key            = "terraform.state"
+		region         = "<% .Region %>"
+		encrypt        = true
+		dynamodb_table = "<% .Name %>-terraform-lock"
+		<% if .S3Endpoint %>
+		endpoint         = "<% .S3Endpoint %>"
+		force_path_style = true
+		<% end %>
 	}
 }
 
@@ -30,21 +36,167 @@ variable "device" {
 	default     = "<% .Device %>"
 }
 
+variable "release_retention_days" {
+	description = "Days to keep target files, incrementals and old OTAs in the release bucket"
+	default     = "<% .ReleaseRetention %>"
+}
+
+variable "log_retention_days" {
+	description = "Days to keep build logs streamed to CloudWatch Logs"
+	default     = "<% .LogRetention %>"
+}
+
+variable "no_build_alarm_days" {
+	description = "Days without a successful build before alarming, 0 disables the alarm"
+	default     = "<% .NoBuildAlarmDays %>"
+}
+
+variable "schedule" {
+	description = "How often to check for new releases"
+	default     = "<% .Schedule %>"
+}
+
+variable "notify_sms" {
+	description = "Phone numbers to send build notifications to by SMS"
+	default     = [<% range .NotifySMS %>"<% . %>", <% end %>]
+}
+
 variable "lambda_build_zip_file" {
 	description = "Lambda build zip file"
-	default     = "<% .LambdaSpotZipFile %>"
+	default     = "<% .LambdaBuildZipFile %>"
+}
+
+variable "lambda_notify_zip_file" {
+	description = "Lambda notify zip file"
+	default     = "<% .LambdaNotifyZipFile %>"
 }
 
 variable "shell_script_file" {
 	description = "Shell script file"
 	default     = "<% .ShellScriptFile %>"
 }
+<% if .SSHKey %>
+variable "ssh_cidr" {
+	description = "CIDR block allowed to SSH into build instances"
+	default     = "<% .SSHCIDR %>"
+}
+<% end %><% if .OTADomain %>
+variable "ota_domain" {
+	description = "Custom domain OTA updates are served from"
+	default     = "<% .OTADomain %>"
+}
+
+variable "ota_zone" {
+	description = "Route53 hosted zone for the OTA domain"
+	default     = "<% .OTAZone %>"
+}
+<% end %><% if .ReplicaRegions %>
+variable "replica_regions" {
+	description = "Regions the release bucket is replicated to"
+	default     = [<% range $i, $region := .ReplicaRegions %><% if $i %>, <% end %>"<% $region %>"<% end %>]
+}
+<% end %>
+###################
+# Tags
+###################
+locals {
+  tags = {
+    "chos:stack"   = "${var.name}"
+    "chos:device"  = "${var.device}"
+    "chos:version" = "<% .Version %>"
+  }
+}
 
 ###################
 # Provider
 ###################
 provider "aws" {
 	region = "${var.region}"
+	<% if .S3Endpoint %>
+	s3_force_path_style = true
+	endpoints {
+		s3 = "<% .S3Endpoint %>"
+	}
+	<% end %>
+}
+
+# CloudFront only accepts ACM certificates issued in us-east-1. The provider is
+# kept without --ota-domain, so certificates left in the state can be destroyed
+provider "aws" {
+	alias  = "us_east_1"
+	region = "us-east-1"
+}
+<% range .ReplicaRegions %>
+provider "aws" {
+	alias  = "<% $.ReplicaName . %>"
+	region = "<% . %>"
+}
+<% end %>
+###################
+# VPC
+###################
+data "aws_availability_zones" "available" {}
+
+resource "aws_vpc" "chos" {
+  cidr_block           = "10.0.0.0/16"
+  enable_dns_hostnames = true
+
+  tags = "${merge(local.tags, map("Name", "${var.name}"))}"
+}
+
+resource "aws_internet_gateway" "chos" {
+  vpc_id = "${aws_vpc.chos.id}"
+
+  tags = "${merge(local.tags, map("Name", "${var.name}"))}"
+}
+
+resource "aws_route_table" "chos_public" {
+  vpc_id = "${aws_vpc.chos.id}"
+
+  route {
+    cidr_block = "0.0.0.0/0"
+    gateway_id = "${aws_internet_gateway.chos.id}"
+  }
+
+  tags = "${merge(local.tags, map("Name", "${var.name}-public"))}"
+}
+
+resource "aws_subnet" "chos_public" {
+  count                   = "${length(data.aws_availability_zones.available.names)}"
+  vpc_id                  = "${aws_vpc.chos.id}"
+  cidr_block              = "${cidrsubnet(aws_vpc.chos.cidr_block, 8, count.index)}"
+  availability_zone       = "${element(data.aws_availability_zones.available.names, count.index)}"
+  map_public_ip_on_launch = true
+
+  tags = "${merge(local.tags, map("Name", "${var.name}-public-${element(data.aws_availability_zones.available.names, count.index)}"))}"
+}
+
+resource "aws_route_table_association" "chos_public" {
+  count          = "${length(data.aws_availability_zones.available.names)}"
+  subnet_id      = "${element(aws_subnet.chos_public.*.id, count.index)}"
+  route_table_id = "${aws_route_table.chos_public.id}"
+}
+
+resource "aws_security_group" "chos_build" {
+  name        = "${var.name}-build"
+  description = "CopperheadOS build instances"
+  vpc_id      = "${aws_vpc.chos.id}"
+<% if .SSHKey %>
+  ingress {
+    from_port   = 22
+    to_port     = 22
+    protocol    = "tcp"
+    cidr_blocks = ["${var.ssh_cidr}"]
+  }
+<% end %>
+  egress {
+    from_port   = 0
+    to_port     = 0
+    protocol    = "-1"
+    cidr_blocks = ["0.0.0.0/0"]
+  }
+
+  tags = "${merge(local.tags, map("Name", "${var.name}-build"))}"
 }
 
 ###################
@@ -67,6 +219,8 @@ resource "aws_iam_role" "chos_ec2_role" {
 ]
 }
 EOF
+
+	tags = "${local.tags}"
 }
   
 resource "aws_iam_role_policy" "chos_ec2_policy" {
@@ -108,6 +262,8 @@ resource "aws_iam_role" "chos_lambda_role" {
 ]
 }
 EOF
+
+	tags = "${local.tags}"
 }
 
 resource "aws_iam_role_policy" "chos_lambda_policy" {
@@ -144,6 +300,8 @@ resource "aws_iam_role" "chos_spot_fleet_role" {
 ]
 }
 EOF
+
+	tags = "${local.tags}"
 }
 
 resource "aws_iam_role_policy" "chos_spot_fleet_policy" {
@@ -169,22 +327,123 @@ EOF
 resource "aws_s3_bucket" "chos_s3_keys" {
   bucket = "${var.name}-keys"
   acl    = "private"
+  <% if not .S3Endpoint %>
+  server_side_encryption_configuration {
+    rule {
+      apply_server_side_encryption_by_default {
+        sse_algorithm = "AES256"
+      }
+    }
+  }
+  <% end %>
+
+  tags = "${local.tags}"
 }
 resource "aws_s3_bucket" "chos_s3_logs" {
   bucket = "${var.name}-logs"
   acl    = "private"
+
+  tags = "${local.tags}"
 }
 resource "aws_s3_bucket" "chos_s3_release" {
   bucket = "${var.name}-release"
   acl    = "public-read"
+<% if .ReplicaRegions %>
+  versioning {
+    enabled = true
+  }
+
+  # a rule per replica region, rules with a filter can share objects
+  replication_configuration {
+    role = "${aws_iam_role.chos_replication.arn}"
+<% range $i, $region := .ReplicaRegions %>
+    rules {
+      id       = "release-<% $region %>"
+      priority = <% $i %>
+      status   = "Enabled"
+
+      filter {
+        prefix = ""
+      }
 
+      destination {
+        bucket = "${aws_s3_bucket.chos_s3_release_<% $.ReplicaName $region %>.arn}"
+      }
+    }
+<% end %>  }
+<% end %>
   lifecycle_rule {
     id      = "target"
     enabled = true
     prefix  = "${var.device}-target/"
 
     expiration {
-      days = 30
+      days = "${var.release_retention_days}"
+    }<% if .ReplicaRegions %>
+
+    # replication needs versioning, don't keep replaced and expired updates
+    noncurrent_version_expiration {
+      days = 1
+    }<% end %>
+  }
+
+  lifecycle_rule {
+    id      = "incremental"
+    enabled = true
+    prefix  = "${var.device}-incremental"
+
+    expiration {
+      days = "${var.release_retention_days}"
+    }<% if .ReplicaRegions %>
+
+    # replication needs versioning, don't keep replaced and expired updates
+    noncurrent_version_expiration {
+      days = 1
+    }<% end %>
+  }
+
+  lifecycle_rule {
+    id      = "ota"
+    enabled = true
+    prefix  = "${var.device}-ota"
+
+    expiration {
+      days = "${var.release_retention_days}"
+    }<% if .ReplicaRegions %>
+
+    # replication needs versioning, don't keep replaced and expired updates
+    noncurrent_version_expiration {
+      days = 1
+    }<% end %>
+  }
+
+  tags = "${local.tags}"
+}
+<% if .ReplicaRegions %>
+###################
+# Release Replicas
+###################
+# lifecycle rules aren't replicated, so the replicas expire updates on their own
+<% range .ReplicaRegions %>resource "aws_s3_bucket" "chos_s3_release_<% $.ReplicaName . %>" {
+  provider = "aws.<% $.ReplicaName . %>"
+  bucket   = "${var.name}-release-<% . %>"
+  acl      = "public-read"
+
+  versioning {
+    enabled = true
+  }
+
+  lifecycle_rule {
+    id      = "target"
+    enabled = true
+    prefix  = "${var.device}-target/"
+
+    expiration {
+      days = "${var.release_retention_days}"
+    }
+
+    noncurrent_version_expiration {
+      days = 1
     }
   }
 
@@ -194,7 +453,11 @@ resource "aws_s3_bucket" "chos_s3_release" {
     prefix  = "${var.device}-incremental"
 
     expiration {
-      days = 30
+      days = "${var.release_retention_days}"
+    }
+
+    noncurrent_version_expiration {
+      days = 1
     }
   }
 
@@ -204,13 +467,77 @@ resource "aws_s3_bucket" "chos_s3_release" {
     prefix  = "${var.device}-ota"
 
     expiration {
-      days = 30
+      days = "${var.release_retention_days}"
+    }
+
+    noncurrent_version_expiration {
+      days = 1
     }
   }
+
+  tags = "${local.tags}"
+}
+
+<% end %>resource "aws_iam_role" "chos_replication" {
+  name = "${var.name}-replication"
+  assume_role_policy = <<EOF
+{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Action": "sts:AssumeRole",
+      "Principal": {
+        "Service": "s3.amazonaws.com"
+      },
+      "Effect": "Allow"
+    }
+  ]
+}
+EOF
+}
+
+resource "aws_iam_role_policy" "chos_replication" {
+  name = "${var.name}-replication"
+  role = "${aws_iam_role.chos_replication.id}"
+  policy = <<EOF
+{
+  "Version": "2012-10-17",
+  "Statement": [
+    {
+      "Action": [
+        "s3:GetReplicationConfiguration",
+        "s3:ListBucket"
+      ],
+      "Effect": "Allow",
+      "Resource": "${aws_s3_bucket.chos_s3_release.arn}"
+    },
+    {
+      "Action": [
+        "s3:GetObjectVersion",
+        "s3:GetObjectVersionAcl",
+        "s3:GetObjectVersionTagging"
+      ],
+      "Effect": "Allow",
+      "Resource": "${aws_s3_bucket.chos_s3_release.arn}/*"
+    },
+    {
+      "Action": [
+        "s3:ReplicateObject",
+        "s3:ReplicateDelete",
+        "s3:ReplicateTags"
+      ],
+      "Effect": "Allow",
+      "Resource": [<% range $i, $region := .ReplicaRegions %><% if $i %>, <% end %>"${aws_s3_bucket.chos_s3_release_<% $.ReplicaName $region %>.arn}/*"<% end %>]
+    }
+  ]
 }
-resource "aws_s3_bucket" "chos_s3_script" {
+EOF
+}
+<% end %>resource "aws_s3_bucket" "chos_s3_script" {
   bucket = "${var.name}-script"
   acl    = "private"
+
+  tags = "${local.tags}"
 }
 
 resource "aws_s3_bucket_object" "chos_s3_script_file" {
@@ -222,11 +549,146 @@ resource "aws_s3_bucket_object" "chos_s3_script_file" {
   depends_on = ["aws_s3_bucket.chos_s3_script"]
 }
 
+<% if .OTADomain %>
+###################
+# OTA Domain
+###################
+data "aws_route53_zone" "chos_ota" {
+  name         = "${var.ota_zone}."
+  private_zone = false
+}
+
+resource "aws_acm_certificate" "chos_ota" {
+  provider          = "aws.us_east_1"
+  domain_name       = "${var.ota_domain}"
+  validation_method = "DNS"
+
+  tags = "${local.tags}"
+}
+
+resource "aws_route53_record" "chos_ota_validation" {
+  zone_id = "${data.aws_route53_zone.chos_ota.zone_id}"
+  name    = "${aws_acm_certificate.chos_ota.domain_validation_options.0.resource_record_name}"
+  type    = "${aws_acm_certificate.chos_ota.domain_validation_options.0.resource_record_type}"
+  records = ["${aws_acm_certificate.chos_ota.domain_validation_options.0.resource_record_value}"]
+  ttl     = 60
+}
+
+resource "aws_acm_certificate_validation" "chos_ota" {
+  provider                = "aws.us_east_1"
+  certificate_arn         = "${aws_acm_certificate.chos_ota.arn}"
+  validation_record_fqdns = ["${aws_route53_record.chos_ota_validation.fqdn}"]
+}
+
+resource "aws_cloudfront_distribution" "chos_ota" {
+  enabled         = true
+  is_ipv6_enabled = true
+  comment         = "${var.name} OTA updates"
+  aliases         = ["${var.ota_domain}"]
+
+  origin {
+    domain_name = "${aws_s3_bucket.chos_s3_release.bucket_regional_domain_name}"
+    origin_id   = "${var.name}-release"
+  }
+<% if .ReplicaRegions %>
+  origin {
+    domain_name = "${aws_s3_bucket.chos_s3_release_<% .ReplicaName (index .ReplicaRegions 0) %>.bucket_regional_domain_name}"
+    origin_id   = "${var.name}-release-replica"
+  }
+
+  # serve from the first replica while the region of the release bucket is
+  # unavailable, origin groups fail over to a single other origin
+  origin_group {
+    origin_id = "${var.name}-release-group"
+
+    failover_criteria {
+      status_codes = [500, 502, 503, 504]
+    }
+
+    member {
+      origin_id = "${var.name}-release"
+    }
+
+    member {
+      origin_id = "${var.name}-release-replica"
+    }
+  }
+<% end %>
+  default_cache_behavior {
+    allowed_methods        = ["GET", "HEAD"]
+    cached_methods         = ["GET", "HEAD"]
+    target_origin_id       = "${var.name}-release<% if .ReplicaRegions %>-group<% end %>"
+    viewer_protocol_policy = "redirect-to-https"
+
+    # release metadata is overwritten in place, so keep it fresh
+    min_ttl     = 0
+    default_ttl = 60
+    max_ttl     = 3600
+
+    forwarded_values {
+      query_string = false
+      cookies {
+        forward = "none"
+      }
+    }
+  }
+
+  restrictions {
+    geo_restriction {
+      restriction_type = "none"
+    }
+  }
+
+  viewer_certificate {
+    acm_certificate_arn      = "${aws_acm_certificate_validation.chos_ota.certificate_arn}"
+    ssl_support_method       = "sni-only"
+    minimum_protocol_version = "TLSv1.1_2016"
+  }
+
+  tags = "${local.tags}"
+}
+
+resource "aws_route53_record" "chos_ota" {
+  zone_id = "${data.aws_route53_zone.chos_ota.zone_id}"
+  name    = "${var.ota_domain}"
+  type    = "A"
+
+  alias {
+    name                   = "${aws_cloudfront_distribution.chos_ota.domain_name}"
+    zone_id                = "${aws_cloudfront_distribution.chos_ota.hosted_zone_id}"
+    evaluate_target_health = false
+  }
+}
+
+resource "aws_route53_record" "chos_ota_ipv6" {
+  zone_id = "${data.aws_route53_zone.chos_ota.zone_id}"
+  name    = "${var.ota_domain}"
+  type    = "AAAA"
+
+  alias {
+    name                   = "${aws_cloudfront_distribution.chos_ota.domain_name}"
+    zone_id                = "${aws_cloudfront_distribution.chos_ota.hosted_zone_id}"
+    evaluate_target_health = false
+  }
+}
+<% end %>
 ###################
 # SNS
 ###################
 resource "aws_sns_topic" "chos" {
   name = "${var.name}"
+
+  tags = "${local.tags}"
+}
+
+###################
+# CloudWatch Logs
+###################
+resource "aws_cloudwatch_log_group" "chos_builds" {
+  name              = "${var.name}-builds"
+  retention_in_days = "${var.log_retention_days}"
+
+  tags = "${local.tags}"
 }
 
 ###################
@@ -236,10 +698,102 @@ resource "aws_lambda_function" "chos_lambda_build" {
 	filename         = "${var.lambda_build_zip_file}"
 	function_name    = "${var.name}-build"
 	role             = "${aws_iam_role.chos_lambda_role.arn}"
-	handler          = "lambda_spot_function.lambda_handler"
+	handler          = "bootstrap"
 	source_code_hash = "${base64sha256(file("${var.lambda_build_zip_file}"))}"
+	runtime          = "provided"
+	timeout          = "60"
+
+	environment {
+		variables = {
+			CHECKER_CONFIG    = <% .CheckerConfigString %>
+			SUBNET_IDS        = "${join(",", aws_subnet.chos_public.*.id)}"
+			SECURITY_GROUP_ID = "${aws_security_group.chos_build.id}"
+			SNS_TOPIC_ARN     = "${aws_sns_topic.chos.arn}"
+		}
+	}
+
+	tags = "${local.tags}"
+}
+
+resource "aws_lambda_function" "chos_lambda_notify" {
+	filename         = "${var.lambda_notify_zip_file}"
+	function_name    = "${var.name}-notify"
+	role             = "${aws_iam_role.chos_lambda_role.arn}"
+	handler          = "lambda_notify_function.lambda_handler"
+	source_code_hash = "${base64sha256(file("${var.lambda_notify_zip_file}"))}"
 	runtime          = "python3.6"
-	timeout          = "20"
+	timeout          = "60"
+
+	tags = "${local.tags}"
+}
+
+resource "aws_sns_topic_subscription" "chos_sms" {
+	count     = "${length(var.notify_sms)}"
+	topic_arn = "${aws_sns_topic.chos.arn}"
+	protocol  = "sms"
+	endpoint  = "${element(var.notify_sms, count.index)}"
+}
+
+resource "aws_sns_topic_subscription" "chos_notify" {
+	topic_arn = "${aws_sns_topic.chos.arn}"
+	protocol  = "lambda"
+	endpoint  = "${aws_lambda_function.chos_lambda_notify.arn}"
+}
+
+resource "aws_lambda_permission" "allow_sns_to_call_notify" {
+	statement_id  = "AllowExecutionFromSNS"
+	action        = "lambda:InvokeFunction"
+	function_name = "${aws_lambda_function.chos_lambda_notify.function_name}"
+	principal     = "sns.amazonaws.com"
+	source_arn    = "${aws_sns_topic.chos.arn}"
+}
+
+###################
+# CloudWatch Metrics
+###################
+resource "aws_cloudwatch_dashboard" "chos" {
+  dashboard_name = "${var.name}"
+
+  dashboard_body = <<EOF
+<% .DashboardBody %>
+EOF
+}
+<% if .NoBuildAlarmDays %>
+resource "aws_cloudwatch_metric_alarm" "chos_no_successful_build" {
+  alarm_name          = "${var.name}-no-successful-build"
+  alarm_description   = "No successful CopperheadOS build of ${var.device} in ${var.no_build_alarm_days} days"
+  namespace           = "CopperheadOS"
+  metric_name         = "BuildSuccess"
+  statistic           = "Sum"
+  period              = "86400"
+  evaluation_periods  = "${var.no_build_alarm_days}"
+  comparison_operator = "LessThanThreshold"
+  threshold           = "1"
+  treat_missing_data  = "breaching"
+  alarm_actions       = ["${aws_sns_topic.chos.arn}"]
+
+  dimensions {
+    Stack  = "${var.name}"
+    Device = "${var.device}"
+  }
+}
+<% end %>
+resource "aws_cloudwatch_metric_alarm" "chos_lambda_errors" {
+  alarm_name          = "${var.name}-build-lambda-errors"
+  alarm_description   = "CopperheadOS build checker Lambda ${aws_lambda_function.chos_lambda_build.function_name} failed"
+  namespace           = "AWS/Lambda"
+  metric_name         = "Errors"
+  statistic           = "Sum"
+  period              = "900"
+  evaluation_periods  = "1"
+  comparison_operator = "GreaterThanThreshold"
+  threshold           = "0"
+  treat_missing_data  = "notBreaching"
+  alarm_actions       = ["${aws_sns_topic.chos.arn}"]
+
+  dimensions {
+    FunctionName = "${aws_lambda_function.chos_lambda_build.function_name}"
+  }
 }
 
 ###################
@@ -247,8 +801,10 @@ resource "aws_lambda_function" "chos_lambda_build" {
 ###################
 resource "aws_cloudwatch_event_rule" "every_day" {
     name = "${var.name}-daily-check"
-    description = "CopperheadOS daily build check"
-    schedule_expression = "rate(1 day)"
+    description = "CopperheadOS build check"
+    schedule_expression = "${var.schedule}"
+
+    tags = "${local.tags}"
 }
 
 resource "aws_cloudwatch_event_target" "check_build_every_day" {
@@ -264,7 +820,53 @@ resource "aws_lambda_permission" "allow_cloudwatch_to_call_check_foo" {
     principal = "events.amazonaws.com"
     source_arn = "${aws_cloudwatch_event_rule.every_day.arn}"
 }
- 
+
+resource "aws_cloudwatch_event_rule" "fallback_check" {
+    name = "${var.name}-fallback-check"
+    description = "CopperheadOS check for unfulfilled spot requests"
+    schedule_expression = "rate(15 minutes)"
+
+    tags = "${local.tags}"
+}
+
+resource "aws_cloudwatch_event_target" "fallback_check" {
+    rule = "${aws_cloudwatch_event_rule.fallback_check.name}"
+    target_id = "${var.name}-fallback"
+    arn = "${aws_lambda_function.chos_lambda_build.arn}"
+    input = "{\"action\": \"fallback\"}"
+}
+
+resource "aws_lambda_permission" "allow_cloudwatch_fallback_check" {
+    statement_id = "AllowFallbackExecutionFromCloudWatch"
+    action = "lambda:InvokeFunction"
+    function_name = "${aws_lambda_function.chos_lambda_build.function_name}"
+    principal = "events.amazonaws.com"
+    source_arn = "${aws_cloudwatch_event_rule.fallback_check.arn}"
+}
+<% if .BuildWindow %>
+resource "aws_cloudwatch_event_rule" "deferred_check" {
+    name = "${var.name}-deferred-check"
+    description = "CopperheadOS start builds deferred until the build window"
+    schedule_expression = "rate(15 minutes)"
+
+    tags = "${local.tags}"
+}
+
+resource "aws_cloudwatch_event_target" "deferred_check" {
+    rule = "${aws_cloudwatch_event_rule.deferred_check.name}"
+    target_id = "${var.name}-deferred"
+    arn = "${aws_lambda_function.chos_lambda_build.arn}"
+    input = "{\"action\": \"deferred\"}"
+}
+
+resource "aws_lambda_permission" "allow_cloudwatch_deferred_check" {
+    statement_id = "AllowDeferredExecutionFromCloudWatch"
+    action = "lambda:InvokeFunction"
+    function_name = "${aws_lambda_function.chos_lambda_build.function_name}"
+    principal = "events.amazonaws.com"
+    source_arn = "${aws_cloudwatch_event_rule.deferred_check.arn}"
+}
+<% end %> 
 ###################
 # Outputs
 ###################
@@ -280,4 +882,16 @@ output "iam_ec2_instance_profile_arn" {
 	description = "The EC2 instance profile ARN"
 	value = "${aws_iam_instance_profile.chos_ec2_role.arn}"
 }
-`
+output "subnet_ids" {
+	description = "The public subnets build instances are launched in"
+	value = "${join(",", aws_subnet.chos_public.*.id)}"
+}
+output "security_group_id" {
+	description = "The security group attached to build instances"
+	value = "${aws_security_group.chos_build.id}"
+}
+<% if .OTADomain %>output "ota_cloudfront_domain" {
+	description = "The CloudFront domain serving OTA updates"
+	value = "${aws_cloudfront_distribution.chos_ota.domain_name}"
+}
+<% end %>`
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	"github.com/dan-v/copperheados-stack/stack"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var watchInterval time.Duration
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Follow the current build of a stack with its stage and elapsed time",
+	Run: func(cmd *cobra.Command, args []string) {
+		err := stack.AWSWatch(stack.StackConfig{
+			Name:       name,
+			Region:     region,
+			S3Endpoint: s3Endpoint,
+		}, device, watchInterval)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+func init() {
+	addStackFlags(watchCmd)
+	watchCmd.Flags().StringVarP(&device, "device", "d", "", "device of the build to follow.")
+	watchCmd.MarkFlagRequired("device")
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 15*time.Second, "how often to check for new build events.")
+	addS3EndpointFlag(watchCmd)
+	RootCmd.AddCommand(watchCmd)
+}